@@ -3,12 +3,237 @@ package main
 import "fmt"
 
 type Apu struct {
+	pulse1   ApuPulse
+	pulse2   ApuPulse
+	triangle ApuTriangle
+	noise    ApuNoise
+	dmc      ApuDmc
+
 	status ApuStatus
+	cycle  uint64 // CPU cycles since power on
+
+	// Frame sequencer state
+	frameCycle      int  // CPU cycles since the start of the sequence
+	frameFiveStep   bool // 5-step (true) or 4-step (false) sequence
+	frameIrqInhibit bool
+	frameIrq        bool
+	frameResetDelay int // Cycles until a $4017 write resets the sequence
+
+	timing    *RegionTiming
+	mem       *MemoryMap  // For DMC sample fetches
+	expansion AudioMapper // Cartridge sound hardware, if any
+
+	Mixer ApuMixer
+
+	// Output sampling state. Recording has its own resampler, which stays at
+	// the nominal rate while AudioPacer nudges the one feeding Output, so
+	// recordings don't depend on the audio device.
+	resampler       *Resampler
+	recordResampler *Resampler
+	samplesPerSend  int
+	buffer          []int16
+	recordBuffer    []int16
+	Output          chan []int16 // Receives full sample buffers, if set
+	Recorder        *WavWriter   // Records every sample, if set
 }
 
 type ApuStatus uint8
 
+const (
+	ApuSampleRate     = 44100 // Default output rate
+	ApuSendsPerSecond = 60    // Send about one video frame of audio at a time
+)
+
+// Frame sequencer steps, in CPU cycles. In the 4-step sequence, the fourth
+// step also raises the IRQ from one cycle earlier; the fifth step is only in
+// the 5-step sequence.
+var ntscFrameSteps = [5]int{7457, 14913, 22371, 29829, 37281}
+var palFrameSteps = [5]int{8313, 16627, 24939, 33253, 41565}
+
+var apuLengthTable = [32]uint8{
+	10, 254, 20, 2, 40, 4, 80, 6, 160, 8, 60, 10, 14, 12, 26, 14,
+	12, 16, 24, 18, 48, 20, 96, 22, 192, 24, 72, 26, 16, 28, 32, 30,
+}
+
+func NewApu() *Apu {
+	apu := &Apu{Mixer: NewApuMixer()}
+	apu.pulse1.onesComplement = true // Pulse 1 negates its sweep with one's complement
+	apu.noise.shift = 1
+	apu.dmc.bitsRemaining = 8
+	apu.SetRegion(RegionNtsc)
+	apu.SetSampleRate(ApuSampleRate)
+	return apu
+}
+
+// Selects the clock rate and timer tables of a region, before running. The
+// output sample rate must be set again afterwards.
+func (apu *Apu) SetRegion(region Region) {
+	apu.timing = region.Timing()
+	apu.noise.periods = apu.timing.noisePeriods
+	apu.noise.period = apu.noise.periods[0]
+	apu.dmc.periods = apu.timing.dmcPeriods
+	apu.dmc.period = apu.dmc.periods[0]
+}
+
+func (apu *Apu) SetSampleRate(rate int) {
+	apu.resampler = NewResampler(float64(apu.timing.cpuFrequency), float64(rate))
+	apu.recordResampler = NewResampler(float64(apu.timing.cpuFrequency), float64(rate))
+	apu.samplesPerSend = rate / ApuSendsPerSecond
+	apu.buffer = make([]int16, 0, apu.samplesPerSend)
+	apu.recordBuffer = make([]int16, 0, apu.samplesPerSend)
+}
+
 func (apu *Apu) Step(cycles int) {
+	for i := 0; i < cycles; i++ {
+		apu.clock()
+	}
+}
+
+func (apu *Apu) clock() {
+	apu.cycle++
+	apu.clockFrameSequencer()
+
+	apu.triangle.clockTimer()
+	apu.noise.clockTimer()
+	apu.dmc.clockTimer()
+	if apu.expansion != nil {
+		apu.expansion.ClockAudio()
+	}
+	if apu.dmc.needsFetch() {
+		apu.dmc.fill(dmcDma(apu.mem, apu.dmc.currentAddr, apu.cycle))
+	}
+
+	// Pulse timers are clocked every other CPU cycle
+	if apu.cycle&1 == 0 {
+		apu.pulse1.clockTimer()
+		apu.pulse2.clockTimer()
+	}
+
+	level := apu.mix()
+	if apu.Output != nil {
+		if sample, ok := apu.resampler.Clock(level); ok {
+			apu.emitSample(sample)
+		}
+	}
+	if apu.Recorder != nil {
+		if sample, ok := apu.recordResampler.Clock(level); ok {
+			apu.recordSample(sample)
+		}
+	}
+}
+
+// Returns whether the APU is asserting its IRQ line
+func (apu *Apu) Irq() bool {
+	return apu.frameIrq || apu.dmc.irq
+}
+
+func (apu *Apu) clockFrameSequencer() {
+	if apu.frameResetDelay > 0 {
+		apu.frameResetDelay--
+		if apu.frameResetDelay == 0 {
+			apu.frameCycle = 0
+			if apu.frameFiveStep {
+				// Entering 5-step mode immediately clocks all units
+				apu.clockQuarterFrame()
+				apu.clockHalfFrame()
+			}
+		}
+	}
+
+	steps := &apu.timing.frameSteps
+	apu.frameCycle++
+	switch apu.frameCycle {
+	case steps[0], steps[2]:
+		apu.clockQuarterFrame()
+	case steps[1]:
+		apu.clockQuarterFrame()
+		apu.clockHalfFrame()
+	case steps[3] - 1:
+		apu.setFrameIrq()
+	case steps[3]:
+		if !apu.frameFiveStep {
+			apu.clockQuarterFrame()
+			apu.clockHalfFrame()
+			apu.setFrameIrq()
+		}
+	case steps[3] + 1:
+		if !apu.frameFiveStep {
+			apu.setFrameIrq()
+			apu.frameCycle = 0
+		}
+	case steps[4]:
+		apu.clockQuarterFrame()
+		apu.clockHalfFrame()
+	case steps[4] + 1:
+		apu.frameCycle = 0
+	}
+}
+
+func (apu *Apu) setFrameIrq() {
+	if !apu.frameFiveStep && !apu.frameIrqInhibit {
+		apu.frameIrq = true
+	}
+}
+
+func (apu *Apu) clockQuarterFrame() {
+	apu.pulse1.envelope.clock()
+	apu.pulse2.envelope.clock()
+	apu.triangle.clockLinearCounter()
+	apu.noise.envelope.clock()
+}
+
+func (apu *Apu) clockHalfFrame() {
+	apu.pulse1.length.clock()
+	apu.pulse1.clockSweep()
+	apu.pulse2.length.clock()
+	apu.pulse2.clockSweep()
+	apu.triangle.length.clock()
+	apu.noise.length.clock()
+}
+
+// Returns the combined output of all channels in [0, 1]
+func (apu *Apu) mix() float32 {
+	levels := [ChannelMax]float32{
+		ChannelPulse1:   float32(apu.pulse1.output()),
+		ChannelPulse2:   float32(apu.pulse2.output()),
+		ChannelTriangle: float32(apu.triangle.output()),
+		ChannelNoise:    float32(apu.noise.output()),
+		ChannelDmc:      float32(apu.dmc.output),
+	}
+	if apu.expansion != nil {
+		levels[ChannelExpansion] = apu.expansion.AudioOutput()
+	}
+	return apu.Mixer.mix(levels)
+}
+
+func (apu *Apu) emitSample(sample int16) {
+	apu.buffer = append(apu.buffer, sample)
+	if len(apu.buffer) < apu.samplesPerSend {
+		return
+	}
+	select {
+	case apu.Output <- apu.buffer:
+		apu.buffer = make([]int16, 0, apu.samplesPerSend)
+	default:
+		// Drop the buffer when the consumer cannot keep up
+		apu.buffer = apu.buffer[:0]
+	}
+}
+
+func (apu *Apu) recordSample(sample int16) {
+	apu.recordBuffer = append(apu.recordBuffer, sample)
+	if len(apu.recordBuffer) == apu.samplesPerSend {
+		apu.FlushRecording()
+	}
+}
+
+// Writes the recorded samples that don't yet fill a buffer, before the
+// recording is closed
+func (apu *Apu) FlushRecording() {
+	if apu.Recorder != nil && len(apu.recordBuffer) > 0 {
+		apu.Recorder.Write(apu.recordBuffer)
+	}
+	apu.recordBuffer = apu.recordBuffer[:0]
 }
 
 func (apu *Apu) Load(addr uint16) uint8 {
@@ -20,31 +245,480 @@ func (apu *Apu) Load(addr uint16) uint8 {
 
 func (apu *Apu) Store(addr uint16, val uint8) {
 	switch {
-  case addr <= 0x4003:
-		// Pulse 1
-  case addr <= 0x4007:
-		// Pulse 2
-  case addr <= 0x400b:
-		// Triangle
-  case addr <= 0x400f:
-		// Noise
-  case addr <= 0x4013:
-		// DMC
+	case addr <= 0x4003:
+		apu.pulse1.store(addr&3, val)
+	case addr <= 0x4007:
+		apu.pulse2.store(addr&3, val)
+	case addr <= 0x400b:
+		apu.triangle.store(addr&3, val)
+	case addr <= 0x400f:
+		apu.noise.store(addr&3, val)
+	case addr <= 0x4013:
+		apu.dmc.store(addr&3, val)
 	case addr == 0x4015:
 		apu.writeStatus(val)
 	case addr == 0x4017:
-		// Frame counter
+		apu.writeFrameCounter(val)
 	}
 }
 
 func (apu *Apu) readStatus() uint8 {
-	return uint8(apu.status)
+	var status uint8
+	if apu.pulse1.length.counter > 0 {
+		status |= 0x01
+	}
+	if apu.pulse2.length.counter > 0 {
+		status |= 0x02
+	}
+	if apu.triangle.length.counter > 0 {
+		status |= 0x04
+	}
+	if apu.noise.length.counter > 0 {
+		status |= 0x08
+	}
+	if apu.dmc.bytesRemaining > 0 {
+		status |= 0x10
+	}
+	if apu.frameIrq {
+		status |= 0x40
+	}
+	if apu.dmc.irq {
+		status |= 0x80
+	}
+	apu.frameIrq = false // Reading acknowledges the frame interrupt
+	return status
 }
 
 func (apu *Apu) writeStatus(status uint8) {
 	apu.status = ApuStatus(status)
+	apu.pulse1.length.setEnabled(apu.status.pulseEnabled(0))
+	apu.pulse2.length.setEnabled(apu.status.pulseEnabled(1))
+	apu.triangle.length.setEnabled(apu.status.triangleEnabled())
+	apu.noise.length.setEnabled(apu.status.noiseEnabled())
+	apu.dmc.setEnabled(apu.status.dmcEnabled())
+}
+
+func (apu *Apu) writeFrameCounter(val uint8) {
+	apu.frameFiveStep = val&0x80 == 0x80
+	apu.frameIrqInhibit = val&0x40 == 0x40
+	if apu.frameIrqInhibit {
+		apu.frameIrq = false
+	}
+
+	// The sequence restarts 3 or 4 CPU cycles after the write, depending on
+	// whether it lands on an APU cycle boundary
+	apu.frameResetDelay = 3
+	if apu.cycle&1 == 1 {
+		apu.frameResetDelay = 4
+	}
 }
 
 func (status ApuStatus) pulseEnabled(ch uint) bool { return (status>>ch)&1 == 1 }
-func (status ApuStatus) triangleEnabled() bool     { return status&0x04 == 1 }
-func (status ApuStatus) noiseEnabled() bool        { return status&0x08 == 1 }
+func (status ApuStatus) triangleEnabled() bool     { return status&0x04 == 0x04 }
+func (status ApuStatus) noiseEnabled() bool        { return status&0x08 == 0x08 }
+func (status ApuStatus) dmcEnabled() bool          { return status&0x10 == 0x10 }
+
+// Pulse (square wave) channel
+type ApuPulse struct {
+	duty           uint8
+	dutyPos        uint8
+	timer          uint16
+	period         uint16
+	envelope       ApuEnvelope
+	length         ApuLengthCounter
+	sweep          ApuSweep
+	onesComplement bool // Pulse 1 subtracts one more when the sweep negates
+}
+
+var pulseDutyTable = [4][8]uint8{
+	{0, 1, 0, 0, 0, 0, 0, 0}, // 12.5%
+	{0, 1, 1, 0, 0, 0, 0, 0}, // 25%
+	{0, 1, 1, 1, 1, 0, 0, 0}, // 50%
+	{1, 0, 0, 1, 1, 1, 1, 1}, // 25% negated
+}
+
+func (pulse *ApuPulse) store(reg uint16, val uint8) {
+	switch reg {
+	case 0:
+		pulse.duty = val >> 6
+		pulse.length.halt = val&0x20 == 0x20
+		pulse.envelope.write(val)
+	case 1:
+		pulse.sweep.write(val)
+	case 2:
+		pulse.period = (pulse.period & 0x700) | uint16(val)
+	case 3:
+		pulse.period = (pulse.period & 0xff) | (uint16(val&7) << 8)
+		pulse.length.load(val >> 3)
+		pulse.envelope.start = true
+		pulse.dutyPos = 0
+	}
+}
+
+func (pulse *ApuPulse) clockTimer() {
+	if pulse.timer == 0 {
+		pulse.timer = pulse.period
+		pulse.dutyPos = (pulse.dutyPos - 1) & 7
+	} else {
+		pulse.timer--
+	}
+}
+
+func (pulse *ApuPulse) sweepTarget() uint16 {
+	change := pulse.period >> pulse.sweep.shift
+	if !pulse.sweep.negate {
+		return pulse.period + change
+	}
+	if pulse.onesComplement {
+		change++
+	}
+	if change > pulse.period {
+		return 0
+	}
+	return pulse.period - change
+}
+
+// The sweep unit mutes the channel when the period is out of range, even if disabled
+func (pulse *ApuPulse) muted() bool {
+	return pulse.period < 8 || pulse.sweepTarget() > 0x7ff
+}
+
+func (pulse *ApuPulse) clockSweep() {
+	sweep := &pulse.sweep
+	if sweep.divider == 0 && sweep.enabled && sweep.shift > 0 && !pulse.muted() {
+		pulse.period = pulse.sweepTarget()
+	}
+	if sweep.divider == 0 || sweep.reload {
+		sweep.divider = sweep.period
+		sweep.reload = false
+	} else {
+		sweep.divider--
+	}
+}
+
+func (pulse *ApuPulse) output() uint8 {
+	if pulse.length.counter == 0 || pulse.muted() || pulseDutyTable[pulse.duty][pulse.dutyPos] == 0 {
+		return 0
+	}
+	return pulse.envelope.volume()
+}
+
+type ApuSweep struct {
+	enabled bool
+	period  uint8
+	negate  bool
+	shift   uint8
+	divider uint8
+	reload  bool
+}
+
+func (sweep *ApuSweep) write(val uint8) {
+	sweep.enabled = val&0x80 == 0x80
+	sweep.period = (val >> 4) & 7
+	sweep.negate = val&0x08 == 0x08
+	sweep.shift = val & 7
+	sweep.reload = true
+}
+
+// Triangle channel
+type ApuTriangle struct {
+	timer         uint16
+	period        uint16
+	sequencePos   uint8
+	length        ApuLengthCounter
+	linearCounter uint8
+	linearReload  uint8
+	reloadFlag    bool
+	control       bool // Also halts the length counter
+}
+
+var triangleSequence = [32]uint8{
+	15, 14, 13, 12, 11, 10, 9, 8, 7, 6, 5, 4, 3, 2, 1, 0,
+	0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15,
+}
+
+func (tri *ApuTriangle) store(reg uint16, val uint8) {
+	switch reg {
+	case 0:
+		tri.control = val&0x80 == 0x80
+		tri.length.halt = tri.control
+		tri.linearReload = val & 0x7f
+	case 2:
+		tri.period = (tri.period & 0x700) | uint16(val)
+	case 3:
+		tri.period = (tri.period & 0xff) | (uint16(val&7) << 8)
+		tri.length.load(val >> 3)
+		tri.reloadFlag = true
+	}
+}
+
+func (tri *ApuTriangle) clockTimer() {
+	if tri.timer > 0 {
+		tri.timer--
+		return
+	}
+	tri.timer = tri.period
+	// The sequencer only advances when both counters are non-zero
+	if tri.length.counter > 0 && tri.linearCounter > 0 {
+		tri.sequencePos = (tri.sequencePos + 1) & 0x1f
+	}
+}
+
+func (tri *ApuTriangle) clockLinearCounter() {
+	if tri.reloadFlag {
+		tri.linearCounter = tri.linearReload
+	} else if tri.linearCounter > 0 {
+		tri.linearCounter--
+	}
+	if !tri.control {
+		tri.reloadFlag = false
+	}
+}
+
+func (tri *ApuTriangle) output() uint8 {
+	// Silencing the channel would pop, so it holds the last sequencer output
+	return triangleSequence[tri.sequencePos]
+}
+
+// Noise channel
+type ApuNoise struct {
+	timer     uint16
+	period    uint16
+	periods   *[16]uint16 // For the region
+	shortMode bool
+	shift     uint16 // 15-bit linear feedback shift register
+	envelope  ApuEnvelope
+	length    ApuLengthCounter
+}
+
+// Noise timer periods, in CPU cycles
+var ntscNoisePeriods = [16]uint16{
+	4, 8, 16, 32, 64, 96, 128, 160, 202, 254, 380, 508, 762, 1016, 2034, 4068,
+}
+var palNoisePeriods = [16]uint16{
+	4, 8, 14, 30, 60, 88, 118, 148, 188, 236, 354, 472, 708, 944, 1890, 3778,
+}
+
+func (noise *ApuNoise) store(reg uint16, val uint8) {
+	switch reg {
+	case 0:
+		noise.length.halt = val&0x20 == 0x20
+		noise.envelope.write(val)
+	case 2:
+		noise.shortMode = val&0x80 == 0x80
+		noise.period = noise.periods[val&0xf]
+	case 3:
+		noise.length.load(val >> 3)
+		noise.envelope.start = true
+	}
+}
+
+func (noise *ApuNoise) clockTimer() {
+	if noise.timer > 0 {
+		noise.timer--
+		return
+	}
+	noise.timer = noise.period - 1
+
+	// Short mode taps bit 6 instead of bit 1, giving a 93-step sequence
+	tap := uint(1)
+	if noise.shortMode {
+		tap = 6
+	}
+	feedback := (noise.shift ^ (noise.shift >> tap)) & 1
+	noise.shift = (noise.shift >> 1) | (feedback << 14)
+}
+
+func (noise *ApuNoise) output() uint8 {
+	if noise.length.counter == 0 || noise.shift&1 == 1 {
+		return 0
+	}
+	return noise.envelope.volume()
+}
+
+// Delta modulation channel
+type ApuDmc struct {
+	irqEnabled bool
+	loop       bool
+	irq        bool
+	timer      uint16
+	period     uint16
+	periods    *[16]uint16 // For the region
+
+	// Memory reader
+	sampleAddr     uint16
+	sampleLength   uint16
+	currentAddr    uint16
+	bytesRemaining uint16
+	sampleBuffer   uint8
+	bufferFull     bool
+
+	// Output unit
+	shift         uint8
+	bitsRemaining uint8
+	silence       bool
+	output        uint8 // 7-bit output level
+}
+
+// DMC timer periods, in CPU cycles
+var ntscDmcPeriods = [16]uint16{
+	428, 380, 340, 320, 286, 254, 226, 214, 190, 160, 142, 128, 106, 84, 72, 54,
+}
+var palDmcPeriods = [16]uint16{
+	398, 354, 316, 298, 276, 236, 210, 198, 176, 148, 132, 118, 98, 78, 66, 50,
+}
+
+func (dmc *ApuDmc) store(reg uint16, val uint8) {
+	switch reg {
+	case 0:
+		dmc.irqEnabled = val&0x80 == 0x80
+		dmc.loop = val&0x40 == 0x40
+		dmc.period = dmc.periods[val&0xf]
+		if !dmc.irqEnabled {
+			dmc.irq = false
+		}
+	case 1:
+		dmc.output = val & 0x7f
+	case 2:
+		dmc.sampleAddr = 0xc000 | uint16(val)<<6
+	case 3:
+		dmc.sampleLength = uint16(val)<<4 | 1
+	}
+}
+
+func (dmc *ApuDmc) setEnabled(enabled bool) {
+	dmc.irq = false
+	if !enabled {
+		dmc.bytesRemaining = 0
+	} else if dmc.bytesRemaining == 0 {
+		dmc.restart()
+	}
+}
+
+func (dmc *ApuDmc) restart() {
+	dmc.currentAddr = dmc.sampleAddr
+	dmc.bytesRemaining = dmc.sampleLength
+}
+
+func (dmc *ApuDmc) clockTimer() {
+	if dmc.timer > 0 {
+		dmc.timer--
+		return
+	}
+	dmc.timer = dmc.period - 1
+
+	if !dmc.silence {
+		if dmc.shift&1 == 1 {
+			if dmc.output <= 125 {
+				dmc.output += 2
+			}
+		} else if dmc.output >= 2 {
+			dmc.output -= 2
+		}
+	}
+	dmc.shift >>= 1
+
+	dmc.bitsRemaining--
+	if dmc.bitsRemaining == 0 {
+		dmc.bitsRemaining = 8
+		if dmc.bufferFull {
+			dmc.silence = false
+			dmc.shift = dmc.sampleBuffer
+			dmc.bufferFull = false
+		} else {
+			dmc.silence = true
+		}
+	}
+}
+
+func (dmc *ApuDmc) needsFetch() bool {
+	return !dmc.bufferFull && dmc.bytesRemaining > 0
+}
+
+// Stores a sample byte fetched by the memory reader
+func (dmc *ApuDmc) fill(val uint8) {
+	dmc.sampleBuffer = val
+	dmc.bufferFull = true
+
+	dmc.currentAddr++
+	if dmc.currentAddr == 0 {
+		dmc.currentAddr = 0x8000 // Wraps around to the start of PRG
+	}
+
+	dmc.bytesRemaining--
+	if dmc.bytesRemaining == 0 {
+		if dmc.loop {
+			dmc.restart()
+		} else if dmc.irqEnabled {
+			dmc.irq = true
+		}
+	}
+}
+
+// Envelope generator shared by the pulse and noise channels
+type ApuEnvelope struct {
+	start    bool
+	loop     bool
+	constant bool
+	period   uint8 // Doubles as the constant volume
+	divider  uint8
+	decay    uint8
+}
+
+func (env *ApuEnvelope) write(val uint8) {
+	env.loop = val&0x20 == 0x20
+	env.constant = val&0x10 == 0x10
+	env.period = val & 0xf
+}
+
+func (env *ApuEnvelope) clock() {
+	if env.start {
+		env.start = false
+		env.decay = 15
+		env.divider = env.period
+		return
+	}
+	if env.divider > 0 {
+		env.divider--
+		return
+	}
+	env.divider = env.period
+	if env.decay > 0 {
+		env.decay--
+	} else if env.loop {
+		env.decay = 15
+	}
+}
+
+func (env *ApuEnvelope) volume() uint8 {
+	if env.constant {
+		return env.period
+	}
+	return env.decay
+}
+
+// Length counter shared by the pulse, triangle and noise channels
+type ApuLengthCounter struct {
+	enabled bool
+	halt    bool
+	counter uint8
+}
+
+func (length *ApuLengthCounter) setEnabled(enabled bool) {
+	length.enabled = enabled
+	if !enabled {
+		length.counter = 0
+	}
+}
+
+func (length *ApuLengthCounter) load(index uint8) {
+	if length.enabled {
+		length.counter = apuLengthTable[index&0x1f]
+	}
+}
+
+func (length *ApuLengthCounter) clock() {
+	if !length.halt && length.counter > 0 {
+		length.counter--
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import "testing"
+
+func TestApuPulseSweepNegate(t *testing.T) {
+	apu := NewApu()
+	apu.Store(0x4001, 0x89) // Enabled, negate, shift 1
+	apu.Store(0x4005, 0x89)
+	apu.Store(0x4002, 0x00)
+	apu.Store(0x4003, 0x01)
+	apu.Store(0x4006, 0x00)
+	apu.Store(0x4007, 0x01)
+
+	// Pulse 1 uses one's complement, pulse 2 two's complement
+	if target := apu.pulse1.sweepTarget(); target != 0x7f {
+		t.Errorf("Pulse 1 sweep target %x, expected 7f", target)
+	}
+	if target := apu.pulse2.sweepTarget(); target != 0x80 {
+		t.Errorf("Pulse 2 sweep target %x, expected 80", target)
+	}
+}
+
+func TestApuPulseLengthCounter(t *testing.T) {
+	apu := NewApu()
+	apu.Store(0x4003, 0x08) // Ignored while the channel is disabled
+	if apu.Load(0x4015)&1 != 0 {
+		t.Errorf("Length counter loaded on disabled channel")
+	}
+
+	apu.Store(0x4015, 0x01)
+	apu.Store(0x4000, 0x00)
+	apu.Store(0x4003, 0x18) // Length index 3: 2 half frames
+	if apu.Load(0x4015)&1 != 1 {
+		t.Fatalf("Length counter not loaded")
+	}
+
+	apu.Step(ntscFrameSteps[3])
+	if apu.Load(0x4015)&1 != 0 {
+		t.Errorf("Length counter not expired after two half frames")
+	}
+}
+
+func TestApuNoiseSequenceLength(t *testing.T) {
+	for _, test := range []struct {
+		mode   uint8
+		length int
+	}{{0x00, 32767}, {0x80, 93}} {
+		noise := ApuNoise{shift: 1, periods: &ntscNoisePeriods}
+		noise.store(2, test.mode)
+		start := noise.shift
+		steps := 0
+		for {
+			noise.timer = 0
+			noise.clockTimer()
+			steps++
+			if noise.shift == start {
+				break
+			}
+		}
+		if steps != test.length {
+			t.Errorf("Mode %x repeated after %v steps, expected %v", test.mode, steps, test.length)
+		}
+	}
+}
+
+func TestApuStatusEnablesTriangleAndNoise(t *testing.T) {
+	apu := NewApu()
+	apu.Store(0x4015, 0x0c)
+	apu.Store(0x400b, 0x08)
+	apu.Store(0x400f, 0x08)
+	if status := apu.Load(0x4015); status != 0x0c {
+		t.Errorf("Status %x, expected c", status)
+	}
+}
+
+func TestApuDmcSampleFetch(t *testing.T) {
+	rom := &Rom{prg: make([]byte, 0x4000)}
+	rom.header.PrgRom16kBanks = 1
+	cpu := &Cpu{}
+	apu := NewApu()
+	mem := &MemoryMap{cpu: cpu, apu: apu, mapper: NewNrom(rom)}
+	cpu.MemoryMap = mem
+	apu.mem = mem
+
+	apu.Store(0x4010, 0x8f) // IRQ enabled, fastest rate
+	apu.Store(0x4012, 0x00) // Sample at 0xc000
+	apu.Store(0x4013, 0x01) // 17 bytes
+	apu.Store(0x4015, 0x10)
+	if apu.Load(0x4015)&0x10 == 0 {
+		t.Fatalf("DMC not active after enable")
+	}
+
+	apu.Step(17 * 8 * 54)
+	if status := apu.Load(0x4015); status&0x90 != 0x80 {
+		t.Errorf("Status %x after sample, expected IRQ without active DMC", status)
+	}
+	if cpu.idleCycles != 17*4 {
+		t.Errorf("CPU stalled %v cycles, expected %v", cpu.idleCycles, 17*4)
+	}
+}
+
+func TestApuFrameIrq(t *testing.T) {
+	for _, test := range []struct {
+		mode uint8
+		irq  bool
+	}{{0x00, true}, {0x40, false}, {0x80, false}} {
+		apu := NewApu()
+		apu.Store(0x4017, test.mode)
+		apu.Step(ntscFrameSteps[4] + 10)
+		if apu.Irq() != test.irq {
+			t.Errorf("Mode %x IRQ %v, expected %v", test.mode, apu.Irq(), test.irq)
+		}
+		if status := apu.Load(0x4015); (status&0x40 == 0x40) != test.irq {
+			t.Errorf("Mode %x status %x", test.mode, status)
+		}
+		if apu.Irq() {
+			t.Errorf("Mode %x IRQ not acknowledged by status read", test.mode)
+		}
+	}
+}
+
+func TestApuMixerNonLinear(t *testing.T) {
+	mixer := NewApuMixer()
+	full := mixer.mix([ChannelMax]float32{15, 15, 15, 15, 127})
+	if full < 0.99 || full > 1.01 {
+		t.Errorf("Full scale output %v, expected about 1", full)
+	}
+
+	// Two pulses at full volume are quieter than twice one pulse
+	one := mixer.mix([ChannelMax]float32{ChannelPulse1: 15})
+	two := mixer.mix([ChannelMax]float32{ChannelPulse1: 15, ChannelPulse2: 15})
+	if two >= 2*one {
+		t.Errorf("Pulse mix %v not compressed relative to %v", two, one)
+	}
+
+	mixer.SetMuted(ChannelPulse2, true)
+	if muted := mixer.mix([ChannelMax]float32{ChannelPulse1: 15, ChannelPulse2: 15}); muted != one {
+		t.Errorf("Muted pulse 2 mix %v, expected %v", muted, one)
+	}
+}
@@ -18,6 +18,19 @@ type Cpu struct {
 	// Cycle count to hold the CPU idle (during DMA)
 	idleCycles int
 
+	// Total cycles elapsed before the current instruction
+	cycles uint64
+
+	// Instruction being executed, for timing its bus accesses. Zero between
+	// instructions.
+	instruction Instruction
+
+	// Interrupt state
+	nmiPending   bool      // Edge-triggered NMI waiting to be serviced
+	nmiDelayed   bool      // NMI raised too late in the last instruction to be polled
+	irqLine      IrqSource // Wired-OR of all sources asserting IRQ
+	irqInhibited bool      // I flag as seen by the last interrupt poll
+
 	*MemoryMap
 }
 
@@ -32,6 +45,14 @@ const (
 	NegativeFlag = 1 << 7
 )
 
+// Devices that can assert the shared IRQ line
+type IrqSource uint8
+
+const (
+	IrqApu IrqSource = 1 << iota
+	IrqMapper
+)
+
 const (
 	NmiVector   = 0xfffa
 	ResetVector = 0xfffc
@@ -41,6 +62,7 @@ const (
 func (cpu *Cpu) Power() {
 	cpu.sp = 0xfd
 	cpu.flags = IrqFlag
+	cpu.irqInhibited = true
 }
 
 func (cpu *Cpu) Reset() {
@@ -49,14 +71,44 @@ func (cpu *Cpu) Reset() {
 	cpu.pc = makeWord(lowByte, highByte)
 }
 
+// Signals an NMI, serviced before the next instruction
 func (cpu *Cpu) Nmi() {
-	push(cpu, uint8(cpu.pc>>8))
-	push(cpu, uint8(cpu.pc&0xff))
-	push(cpu, cpu.flags)
+	cpu.nmiPending = true
+}
 
-	lowNmiAddr := cpu.Load(NmiVector)
-	highNmiAddr := cpu.Load(NmiVector + 1)
-	cpu.pc = makeWord(lowNmiAddr, highNmiAddr)
+// Signals an NMI raised on the last cycle of an instruction, after interrupts
+// were polled, so it is serviced after one more instruction
+func (cpu *Cpu) DelayedNmi() {
+	cpu.nmiDelayed = true
+}
+
+// Withdraws an NMI that has not been serviced yet
+func (cpu *Cpu) CancelNmi() {
+	cpu.nmiPending = false
+	cpu.nmiDelayed = false
+}
+
+// Returns the cycle on which the current instruction accesses its operand. For
+// most instructions that is the last cycle.
+func (cpu *Cpu) accessCycle() uint64 {
+	if cpu.instruction.cycles == 0 {
+		return cpu.cycles
+	}
+	cycles := cpu.instruction.cycles
+	if cpu.pageCrossed && cpu.instruction.hasPageCrossPenalty {
+		cycles++
+	}
+	return cpu.cycles + uint64(cycles) - 1
+}
+
+// Asserts or releases the IRQ line on behalf of a source. The line stays
+// asserted while any source holds it.
+func (cpu *Cpu) SetIrq(source IrqSource, asserted bool) {
+	if asserted {
+		cpu.irqLine |= source
+	} else {
+		cpu.irqLine &^= source
+	}
 }
 
 func (cpu *Cpu) Idle(cycles int) {
@@ -67,15 +119,43 @@ func (cpu *Cpu) Step() int {
 	if cpu.idleCycles > 0 {
 		cycles := cpu.idleCycles
 		cpu.idleCycles = 0
+		cpu.cycles += uint64(cycles)
 		return cycles
 	}
 
+	// Interrupts are polled at the end of the previous instruction
+	if cpu.nmiPending {
+		cpu.nmiPending = false
+		interrupt(cpu, NmiVector, cpu.flags&^BreakFlag)
+		cpu.cycles += 7
+		return 7
+	}
+	if cpu.irqLine != 0 && !cpu.irqInhibited {
+		interrupt(cpu, IrqVector, cpu.flags&^BreakFlag)
+		cpu.cycles += 7
+		return 7
+	}
+
+	irqFlag := cpu.flags & IrqFlag
+	nmiDelayed := cpu.nmiDelayed
+	cpu.nmiDelayed = false
 	opcode := cpu.loadAndIncPc()
 	instruction, ok := instructions[opcode]
 	if !ok {
 		panic(fmt.Sprintf("Unimplemented/illegal instruction %x at %x", opcode, cpu.pc-1))
 	}
+	cpu.instruction = instruction
 	instruction.fn(cpu, instruction.addr)
+	cpu.instruction = Instruction{}
+
+	if nmiDelayed {
+		cpu.nmiPending = true
+	}
+
+	if !instruction.delaysIrqFlag {
+		irqFlag = cpu.flags & IrqFlag
+	}
+	cpu.irqInhibited = irqFlag == IrqFlag
 
 	cycles := instruction.cycles
 	if cpu.pageCrossed && instruction.hasPageCrossPenalty {
@@ -86,6 +166,7 @@ func (cpu *Cpu) Step() int {
 		cycles++
 		cpu.branchTaken = false
 	}
+	cpu.cycles += uint64(cycles)
 	return cycles
 }
 
@@ -200,6 +281,10 @@ type Instruction struct {
 	cycles              int
 	hasPageCrossPenalty bool
 	hasBranchPenalty    bool
+
+	// Whether the I flag changes after the interrupt poll, delaying its effect
+	// by one instruction
+	delaysIrqFlag bool
 }
 
 var instructions = map[uint8]Instruction{
@@ -251,7 +336,7 @@ var instructions = map[uint8]Instruction{
 	0x48: {fn: pha, addr: implied, cycles: 3},
 	0x68: {fn: pla, addr: implied, cycles: 4},
 	0x08: {fn: php, addr: implied, cycles: 3},
-	0x28: {fn: plp, addr: implied, cycles: 4},
+	0x28: {fn: plp, addr: implied, cycles: 4, delaysIrqFlag: true},
 	// AND
 	0x29: {fn: and, addr: immediate, cycles: 2},
 	0x25: {fn: and, addr: zeroPage, cycles: 3},
@@ -375,11 +460,11 @@ var instructions = map[uint8]Instruction{
 	// CLC, CLD, CLI, CLV, SEC, SED, SEI
 	0x18: {fn: clc, addr: implied, cycles: 2},
 	0xd8: {fn: cld, addr: implied, cycles: 2},
-	0x58: {fn: cli, addr: implied, cycles: 2},
+	0x58: {fn: cli, addr: implied, cycles: 2, delaysIrqFlag: true},
 	0xb8: {fn: clv, addr: implied, cycles: 2},
 	0x38: {fn: sec, addr: implied, cycles: 2},
 	0xf8: {fn: sed, addr: implied, cycles: 2},
-	0x78: {fn: sei, addr: implied, cycles: 2},
+	0x78: {fn: sei, addr: implied, cycles: 2, delaysIrqFlag: true},
 	// BRK, RTI
 	0x00: {fn: brk, addr: implied, cycles: 7},
 	0x40: {fn: rti, addr: implied, cycles: 6},
@@ -570,15 +655,7 @@ func sei(cpu *Cpu, addr AddressFn) { cpu.setFlag(IrqFlag, true) }
 
 func brk(cpu *Cpu, addr AddressFn) {
 	cpu.pc++
-	push(cpu, uint8(cpu.pc>>8))
-	push(cpu, uint8(cpu.pc&0xff))
-	push(cpu, cpu.flags|BreakFlag|UnusedFlag)
-
-	cpu.setFlag(IrqFlag, true)
-
-	lowIrqAddr := cpu.Load(IrqVector)
-	highIrqAddr := cpu.Load(IrqVector + 1)
-	cpu.pc = makeWord(lowIrqAddr, highIrqAddr)
+	interrupt(cpu, IrqVector, cpu.flags|BreakFlag)
 }
 
 func rti(cpu *Cpu, addr AddressFn) {
@@ -591,6 +668,19 @@ func rti(cpu *Cpu, addr AddressFn) {
 func nop(cpu *Cpu, addr AddressFn) {}
 
 // Helpers
+func interrupt(cpu *Cpu, vector uint16, flags uint8) {
+	push(cpu, uint8(cpu.pc>>8))
+	push(cpu, uint8(cpu.pc&0xff))
+	push(cpu, flags|UnusedFlag)
+
+	cpu.setFlag(IrqFlag, true)
+	cpu.irqInhibited = true
+
+	lowAddr := cpu.Load(vector)
+	highAddr := cpu.Load(vector + 1)
+	cpu.pc = makeWord(lowAddr, highAddr)
+}
+
 func push(cpu *Cpu, val uint8) {
 	cpu.Store(0x100+uint16(cpu.sp), val)
 	cpu.sp--
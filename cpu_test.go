@@ -29,3 +29,104 @@ func TestCpuRom(t *testing.T) {
 	}
 	t.Logf("Test output: %s", string(ram[4:end]))
 }
+
+// Creates a CPU running the given program from 0x8000 with its IRQ vector at 0x9000
+func newTestCpu(program []uint8) *Cpu {
+	rom := &Rom{prg: make([]byte, 0x4000)}
+	rom.header.PrgRom16kBanks = 1
+	copy(rom.prg, program)
+	rom.prg[ResetVector&0x3fff+1] = 0x80
+	rom.prg[IrqVector&0x3fff+1] = 0x90
+
+	cpu := &Cpu{}
+	cpu.MemoryMap = &MemoryMap{cpu: cpu, apu: NewApu(), mapper: NewNrom(rom)}
+	cpu.Power()
+	cpu.Reset()
+	return cpu
+}
+
+func TestCpuIrqDelayedByCli(t *testing.T) {
+	cpu := newTestCpu([]uint8{
+		0x58, // CLI
+		0xea, // NOP
+		0xea, // NOP
+	})
+	cpu.SetIrq(IrqApu, true)
+
+	cpu.Step() // CLI
+	cpu.Step() // NOP still runs before the IRQ
+	if cpu.pc != 0x8002 {
+		t.Fatalf("PC %x after CLI, NOP; expected 8002", cpu.pc)
+	}
+	if cycles := cpu.Step(); cycles != 7 || cpu.pc != 0x9000 {
+		t.Fatalf("IRQ not taken (cycles %v, PC %x)", cycles, cpu.pc)
+	}
+	if flags := cpu.ram[0x100+uint16(cpu.sp)+1]; flags&BreakFlag != 0 {
+		t.Errorf("IRQ pushed flags %x with B set", flags)
+	}
+	if cpu.flags&IrqFlag == 0 {
+		t.Errorf("IRQ did not set I flag")
+	}
+}
+
+func TestCpuIrqDelayedByPlp(t *testing.T) {
+	cpu := newTestCpu([]uint8{
+		0xa9, 0x00, // LDA #0
+		0x48, // PHA
+		0x28, // PLP
+		0xea, // NOP
+		0xea, // NOP
+	})
+	cpu.SetIrq(IrqApu, true)
+
+	cpu.Step() // LDA
+	cpu.Step() // PHA
+	cpu.Step() // PLP clears I
+	cpu.Step() // NOP still runs before the IRQ
+	if cpu.pc != 0x8005 {
+		t.Fatalf("PC %x after PLP, NOP; expected 8005", cpu.pc)
+	}
+	if cycles := cpu.Step(); cycles != 7 || cpu.pc != 0x9000 {
+		t.Fatalf("IRQ not taken (cycles %v, PC %x)", cycles, cpu.pc)
+	}
+}
+
+func TestCpuIrqTakenAfterSei(t *testing.T) {
+	cpu := newTestCpu([]uint8{
+		0x58, // CLI
+		0xea, // NOP
+		0x78, // SEI
+		0xea, // NOP
+	})
+
+	cpu.Step() // CLI
+	cpu.Step() // NOP
+	cpu.Step() // SEI
+	cpu.SetIrq(IrqApu, true)
+
+	// The IRQ polled during SEI is still taken, with I set in the pushed flags
+	if cycles := cpu.Step(); cycles != 7 || cpu.pc != 0x9000 {
+		t.Fatalf("IRQ not taken after SEI (cycles %v, PC %x)", cycles, cpu.pc)
+	}
+	if flags := cpu.ram[0x100+uint16(cpu.sp)+1]; flags&IrqFlag == 0 {
+		t.Errorf("IRQ pushed flags %x with I clear", flags)
+	}
+}
+
+func TestCpuIrqLineWiredOr(t *testing.T) {
+	cpu := newTestCpu([]uint8{
+		0x58, // CLI
+		0xea, // NOP
+		0xea, // NOP
+	})
+	cpu.SetIrq(IrqApu, true)
+	cpu.SetIrq(IrqMapper, true)
+	cpu.SetIrq(IrqApu, false)
+
+	cpu.Step()
+	cpu.Step()
+	cpu.Step()
+	if cpu.pc != 0x9000 {
+		t.Errorf("IRQ not taken while mapper holds the line (PC %x)", cpu.pc)
+	}
+}
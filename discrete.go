@@ -0,0 +1,182 @@
+package main
+
+// Base for boards built from discrete logic, where writes to PRG ROM set a
+// latch that selects banks. CHR is ROM or 8 KB of RAM.
+type discreteBoard struct {
+	rom    *Rom
+	chrRam []uint8
+
+	// The ROM also drives the bus during latch writes, and a 0 from either side
+	// wins, so games write values that match the ROM byte
+	conflicts bool
+}
+
+func newDiscreteBoard(rom *Rom, conflicts bool) discreteBoard {
+	return discreteBoard{rom: rom, chrRam: make([]uint8, 8192), conflicts: conflicts}
+}
+
+// Returns the value latched when the CPU writes over a ROM byte
+func (board *discreteBoard) latch(val uint8, romVal uint8) uint8 {
+	if board.conflicts {
+		return val & romVal
+	}
+	return val
+}
+
+func (board *discreteBoard) loadChr(bank int, addr uint16) uint8 {
+	if board.rom.header.ChrRom8kBanks == 0 {
+		return board.chrRam[addr]
+	}
+	return loadBanked(board.rom.chr, bank, 0x2000, addr)
+}
+
+func (board *discreteBoard) StoreChr(addr uint16, val uint8) {
+	if board.rom.header.ChrRom8kBanks == 0 {
+		board.chrRam[addr] = val
+	}
+}
+
+// UxROM (mapper 2): switchable 16 KB at 0x8000, last bank fixed at 0xc000
+type Uxrom struct {
+	discreteBoard
+	prgBank uint8
+}
+
+func NewUxrom(rom *Rom) *Uxrom {
+	// Submapper 1 marks boards without bus conflicts
+	return &Uxrom{discreteBoard: newDiscreteBoard(rom, rom.Submapper() != 1)}
+}
+
+func (uxrom *Uxrom) LoadPrg(addr uint16) uint8 {
+	switch {
+	case addr < 0x8000:
+		return 0
+	case addr < 0xc000:
+		return loadBanked(uxrom.rom.prg, int(uxrom.prgBank), 0x4000, addr)
+	}
+	return loadBanked(uxrom.rom.prg, len(uxrom.rom.prg)/0x4000-1, 0x4000, addr)
+}
+
+func (uxrom *Uxrom) StorePrg(addr uint16, val uint8) {
+	if addr >= 0x8000 {
+		uxrom.prgBank = uxrom.latch(val, uxrom.LoadPrg(addr))
+	}
+}
+
+func (uxrom *Uxrom) LoadChr(addr uint16) uint8 { return uxrom.loadChr(0, addr) }
+func (uxrom *Uxrom) Mirroring() Mirroring      { return solderedMirroring(uxrom.rom) }
+
+// CNROM (mapper 3): fixed PRG like NROM, switchable 8 KB CHR
+type Cnrom struct {
+	discreteBoard
+	chrBank uint8
+}
+
+func NewCnrom(rom *Rom) *Cnrom {
+	// Submapper 1 marks boards without bus conflicts
+	return &Cnrom{discreteBoard: newDiscreteBoard(rom, rom.Submapper() != 1)}
+}
+
+func (cnrom *Cnrom) LoadPrg(addr uint16) uint8 {
+	if addr < 0x8000 {
+		return 0
+	}
+	// A single 16 KB bank is mirrored at 0xc000
+	return cnrom.rom.prg[int(addr&0x7fff)%len(cnrom.rom.prg)]
+}
+
+func (cnrom *Cnrom) StorePrg(addr uint16, val uint8) {
+	if addr >= 0x8000 {
+		cnrom.chrBank = cnrom.latch(val, cnrom.LoadPrg(addr))
+	}
+}
+
+func (cnrom *Cnrom) LoadChr(addr uint16) uint8 { return cnrom.loadChr(int(cnrom.chrBank), addr) }
+func (cnrom *Cnrom) Mirroring() Mirroring      { return solderedMirroring(cnrom.rom) }
+
+// AxROM (mapper 7): switchable 32 KB PRG and single-screen mirroring
+type Axrom struct {
+	discreteBoard
+	bank uint8 // Bits 0-2: PRG bank, bit 4: nametable page
+}
+
+func NewAxrom(rom *Rom) *Axrom {
+	// Only ANROM has bus conflicts, marked by submapper 2; AOROM games rely on
+	// their absence
+	return &Axrom{discreteBoard: newDiscreteBoard(rom, rom.Submapper() == 2)}
+}
+
+func (axrom *Axrom) LoadPrg(addr uint16) uint8 {
+	if addr < 0x8000 {
+		return 0
+	}
+	return loadBanked(axrom.rom.prg, int(axrom.bank&7), 0x8000, addr)
+}
+
+func (axrom *Axrom) StorePrg(addr uint16, val uint8) {
+	if addr >= 0x8000 {
+		axrom.bank = axrom.latch(val, axrom.LoadPrg(addr))
+	}
+}
+
+func (axrom *Axrom) LoadChr(addr uint16) uint8 { return axrom.loadChr(0, addr) }
+
+func (axrom *Axrom) Mirroring() Mirroring {
+	if axrom.bank&0x10 == 0 {
+		return MirrorSingleUpper
+	}
+	return MirrorSingleLower
+}
+
+// GxROM (mapper 66): switchable 32 KB PRG and 8 KB CHR
+type Gxrom struct {
+	discreteBoard
+	bank uint8 // Bits 0-1: CHR bank, bits 4-5: PRG bank
+}
+
+func NewGxrom(rom *Rom) *Gxrom {
+	return &Gxrom{discreteBoard: newDiscreteBoard(rom, true)}
+}
+
+func (gxrom *Gxrom) LoadPrg(addr uint16) uint8 {
+	if addr < 0x8000 {
+		return 0
+	}
+	return loadBanked(gxrom.rom.prg, int(gxrom.bank>>4&3), 0x8000, addr)
+}
+
+func (gxrom *Gxrom) StorePrg(addr uint16, val uint8) {
+	if addr >= 0x8000 {
+		gxrom.bank = gxrom.latch(val, gxrom.LoadPrg(addr))
+	}
+}
+
+func (gxrom *Gxrom) LoadChr(addr uint16) uint8 { return gxrom.loadChr(int(gxrom.bank&3), addr) }
+func (gxrom *Gxrom) Mirroring() Mirroring      { return solderedMirroring(gxrom.rom) }
+
+// Color Dreams (mapper 11): switchable 32 KB PRG and 8 KB CHR, with the bits
+// arranged the other way around from GxROM
+type ColorDreams struct {
+	discreteBoard
+	bank uint8 // Bits 0-1: PRG bank, bits 4-7: CHR bank
+}
+
+func NewColorDreams(rom *Rom) *ColorDreams {
+	return &ColorDreams{discreteBoard: newDiscreteBoard(rom, true)}
+}
+
+func (cd *ColorDreams) LoadPrg(addr uint16) uint8 {
+	if addr < 0x8000 {
+		return 0
+	}
+	return loadBanked(cd.rom.prg, int(cd.bank&3), 0x8000, addr)
+}
+
+func (cd *ColorDreams) StorePrg(addr uint16, val uint8) {
+	if addr >= 0x8000 {
+		cd.bank = cd.latch(val, cd.LoadPrg(addr))
+	}
+}
+
+func (cd *ColorDreams) LoadChr(addr uint16) uint8 { return cd.loadChr(int(cd.bank>>4), addr) }
+func (cd *ColorDreams) Mirroring() Mirroring      { return solderedMirroring(cd.rom) }
@@ -0,0 +1,288 @@
+package main
+
+import "math"
+
+// Sunsoft FME-7 (mapper 69), including the Sunsoft 5B sound variant
+type Fme7 struct {
+	rom *Rom
+
+	// RAM
+	prgRam []uint8
+	chrRam []uint8
+
+	// Registers, selected by a write to 0x8000-0x9fff and written at 0xa000-0xbfff
+	command   uint8
+	chrBanks  [8]uint8 // Commands 0-7: 1 KB banks
+	prgBanks  [4]uint8 // Commands 8-b: 8 KB banks at 0x6000, 0x8000, 0xa000, 0xc000
+	mirroring uint8    // Command c
+
+	// IRQ counter, decremented every CPU cycle
+	irqEnabled     bool   // Command d bit 0
+	counterEnabled bool   // Command d bit 7
+	counter        uint16 // Commands e-f
+	irq            bool
+
+	audio Sunsoft5b
+}
+
+func NewFme7(rom *Rom) *Fme7 {
+	return &Fme7{
+		rom:    rom,
+		prgRam: make([]uint8, 8192),
+		chrRam: make([]uint8, 8192),
+		audio:  Sunsoft5b{noiseShift: 1}}
+}
+
+func (fme7 *Fme7) LoadPrg(addr uint16) uint8 {
+	switch {
+	case addr < 0x6000:
+		return 0
+	case addr < 0x8000:
+		bank := fme7.prgBanks[0]
+		if bank&0x40 == 0 {
+			return loadBanked(fme7.rom.prg, int(bank&0x3f), 0x2000, addr)
+		}
+		if bank&0x80 == 0 {
+			return 0 // RAM disabled
+		}
+		return fme7.prgRam[addr-0x6000]
+	case addr < 0xe000:
+		return loadBanked(fme7.rom.prg, int(fme7.prgBanks[(addr-0x6000)>>13]&0x3f), 0x2000, addr)
+	}
+	return loadBanked(fme7.rom.prg, len(fme7.rom.prg)/0x2000-1, 0x2000, addr)
+}
+
+func (fme7 *Fme7) StorePrg(addr uint16, val uint8) {
+	switch {
+	case addr < 0x6000:
+	case addr < 0x8000:
+		if fme7.prgBanks[0]&0xc0 == 0xc0 {
+			fme7.prgRam[addr-0x6000] = val
+		}
+	case addr < 0xa000:
+		fme7.command = val & 0xf
+	case addr < 0xc000:
+		fme7.writeParameter(val)
+	case addr < 0xe000:
+		fme7.audio.register = val & 0xf
+	default:
+		fme7.audio.write(val)
+	}
+}
+
+func (fme7 *Fme7) writeParameter(val uint8) {
+	switch cmd := fme7.command; {
+	case cmd < 8:
+		fme7.chrBanks[cmd] = val
+	case cmd < 0xc:
+		fme7.prgBanks[cmd-8] = val
+	case cmd == 0xc:
+		fme7.mirroring = val & 3
+	case cmd == 0xd:
+		fme7.irqEnabled = val&1 == 1
+		fme7.counterEnabled = val&0x80 == 0x80
+		fme7.irq = false
+	case cmd == 0xe:
+		fme7.counter = (fme7.counter & 0xff00) | uint16(val)
+	case cmd == 0xf:
+		fme7.counter = (fme7.counter & 0xff) | uint16(val)<<8
+	}
+}
+
+func (fme7 *Fme7) LoadChr(addr uint16) uint8 {
+	if fme7.rom.header.ChrRom8kBanks == 0 {
+		return fme7.chrRam[addr]
+	}
+	return loadBanked(fme7.rom.chr, int(fme7.chrBanks[addr>>10]), 0x400, addr)
+}
+
+func (fme7 *Fme7) StoreChr(addr uint16, val uint8) {
+	if fme7.rom.header.ChrRom8kBanks == 0 {
+		fme7.chrRam[addr] = val
+	}
+}
+
+func (fme7 *Fme7) Mirroring() Mirroring {
+	switch fme7.mirroring {
+	case 0:
+		return MirrorVertical
+	case 1:
+		return MirrorHorizontal
+	case 2:
+		return MirrorSingleUpper
+	}
+	return MirrorSingleLower
+}
+
+func (fme7 *Fme7) ClockCpu() {
+	if !fme7.counterEnabled {
+		return
+	}
+	fme7.counter--
+	if fme7.counter == 0xffff && fme7.irqEnabled {
+		fme7.irq = true
+	}
+}
+
+func (fme7 *Fme7) Irq() bool { return fme7.irq }
+
+func (fme7 *Fme7) ClockAudio()          { fme7.audio.clock() }
+func (fme7 *Fme7) AudioOutput() float32 { return fme7.audio.output() }
+
+// Sunsoft 5B: a YM2149F with three square channels sharing a noise generator
+// and an envelope generator
+type Sunsoft5b struct {
+	register uint8 // Selected by 0xc000-0xdfff, written at 0xe000-0xffff
+
+	prescaler  int // Divides the CPU clock by 16
+	tonePeriod [3]uint16
+	toneTimer  [3]uint16
+	toneOut    [3]bool
+
+	noisePeriod uint8
+	noiseTimer  uint8
+	noiseShift  uint32 // 17-bit linear feedback shift register
+
+	mixer  uint8    // Register 7: tone (bits 0-2) and noise (bits 3-5) disables
+	volume [3]uint8 // Registers 8-a: bit 4 selects the envelope
+
+	envPeriod  uint16
+	envTimer   uint16
+	envShape   uint8
+	envStep    uint8 // 32 steps per ramp
+	envAttack  bool
+	envHolding bool
+}
+
+// A 5B channel at full volume roughly matches a 2A03 pulse at full volume
+const sunsoft5bOutputScale = 0.15
+
+// Amplitudes of the 32 envelope levels, 1.5 dB apart. Fixed volumes use every
+// other level.
+var sunsoft5bLevels = makeSunsoft5bLevels()
+
+func makeSunsoft5bLevels() [32]float32 {
+	var levels [32]float32
+	for i := 1; i < 32; i++ {
+		levels[i] = float32(math.Pow(10, float64(i-31)*1.5/20))
+	}
+	return levels
+}
+
+func (audio *Sunsoft5b) write(val uint8) {
+	switch reg := audio.register; {
+	case reg < 6:
+		ch := reg >> 1
+		if reg&1 == 0 {
+			audio.tonePeriod[ch] = (audio.tonePeriod[ch] & 0xf00) | uint16(val)
+		} else {
+			audio.tonePeriod[ch] = (audio.tonePeriod[ch] & 0xff) | uint16(val&0xf)<<8
+		}
+	case reg == 6:
+		audio.noisePeriod = val & 0x1f
+	case reg == 7:
+		audio.mixer = val
+	case reg < 0xb:
+		audio.volume[reg-8] = val & 0x1f
+	case reg == 0xb:
+		audio.envPeriod = (audio.envPeriod & 0xff00) | uint16(val)
+	case reg == 0xc:
+		audio.envPeriod = (audio.envPeriod & 0xff) | uint16(val)<<8
+	case reg == 0xd:
+		audio.envShape = val & 0xf
+		audio.envStep = 0
+		audio.envAttack = val&4 == 4
+		audio.envHolding = false
+	}
+}
+
+func (audio *Sunsoft5b) clock() {
+	audio.prescaler++
+	if audio.prescaler < 16 {
+		return
+	}
+	audio.prescaler = 0
+
+	for ch := range audio.toneTimer {
+		audio.toneTimer[ch]++
+		if audio.toneTimer[ch] >= audio.tonePeriod[ch] {
+			audio.toneTimer[ch] = 0
+			audio.toneOut[ch] = !audio.toneOut[ch]
+		}
+	}
+
+	// Noise shifts at half the tone rate
+	audio.noiseTimer++
+	if audio.noiseTimer >= 2*audio.noisePeriod {
+		audio.noiseTimer = 0
+		feedback := (audio.noiseShift ^ (audio.noiseShift >> 3)) & 1
+		audio.noiseShift = (audio.noiseShift >> 1) | (feedback << 16)
+	}
+
+	audio.envTimer++
+	if audio.envTimer >= audio.envPeriod {
+		audio.envTimer = 0
+		audio.clockEnvelope()
+	}
+}
+
+func (audio *Sunsoft5b) clockEnvelope() {
+	if audio.envHolding {
+		return
+	}
+	audio.envStep++
+	if audio.envStep < 32 {
+		return
+	}
+
+	continues := audio.envShape&8 == 8
+	alternate := audio.envShape&2 == 2
+	hold := audio.envShape&1 == 1
+	switch {
+	case !continues:
+		// Drop to silence and stay there
+		audio.envHolding = true
+		audio.envAttack = false
+		audio.envStep = 31
+	case hold:
+		// Hold the final level, or the opposite one when alternating
+		audio.envHolding = true
+		audio.envStep = 31
+		if alternate {
+			audio.envAttack = !audio.envAttack
+		}
+	default:
+		if alternate {
+			audio.envAttack = !audio.envAttack
+		}
+		audio.envStep = 0
+	}
+}
+
+func (audio *Sunsoft5b) envLevel() uint8 {
+	if audio.envAttack {
+		return audio.envStep
+	}
+	return 31 - audio.envStep
+}
+
+func (audio *Sunsoft5b) output() float32 {
+	var out float32
+	noise := audio.noiseShift&1 == 1
+	for ch := uint(0); ch < 3; ch++ {
+		toneOn := audio.toneOut[ch] || audio.mixer&(1<<ch) != 0
+		noiseOn := noise || audio.mixer&(8<<ch) != 0
+		if !toneOn || !noiseOn {
+			continue
+		}
+		level := audio.envLevel()
+		if audio.volume[ch]&0x10 == 0 {
+			if audio.volume[ch] == 0 {
+				continue
+			}
+			level = audio.volume[ch]<<1 | 1
+		}
+		out += sunsoft5bLevels[level]
+	}
+	return sunsoft5bOutputScale * out
+}
@@ -10,16 +10,106 @@ type Mapper interface {
 	Mirroring() Mirroring
 }
 
+// Implemented by mappers with their own sound hardware. ClockAudio is called
+// by the APU every CPU cycle, and AudioOutput is mixed with the APU channels.
+type AudioMapper interface {
+	ClockAudio()
+	AudioOutput() float32 // Scaled so a 2A03 pulse at full volume is about 0.15
+}
+
+// Implemented by mappers with counters that run on CPU cycles
+type CpuClockedMapper interface {
+	ClockCpu()
+}
+
+// Implemented by mappers that can assert the CPU IRQ line
+type InterruptingMapper interface {
+	Irq() bool
+}
+
+// Implemented by mappers that supply their own nametable memory, such as
+// extra RAM or CHR ROM, in pages 2 and 3 of their Mirroring. Addresses are
+// offsets into 0x2000-0x2fff, so the quadrant is in bits 10-11.
+type NametableMapper interface {
+	LoadNametable(page int, addr uint16) uint8
+	StoreNametable(page int, addr uint16, val uint8)
+}
+
+// Implemented by mappers that watch the PPU address bus, such as the MMC3
+// scanline counter on A12 and the MMC2 CHR latches. Called after each read the
+// PPU makes from the pattern tables or through PPUDATA, and with the VRAM
+// address set through PPUADDR and PPUDATA, along with the PPU dot count.
+type PpuBusMapper interface {
+	PpuAddress(addr uint16, dot uint64)
+}
+
+// What the PPU is fetching while rendering
+type PpuFetch int
+
+const (
+	PpuFetchNametable PpuFetch = iota
+	PpuFetchAttribute
+	PpuFetchBackground // Background pattern
+	PpuFetchSprite     // Sprite pattern
+)
+
+// Implemented by mappers that take part in rendering, such as MMC5 with its
+// separate sprite and background CHR banks, extended attributes and split
+// screen. Called for each rendering fetch with the value read from VRAM and
+// the PPU dot count, returning the value the PPU uses.
+type RenderingMapper interface {
+	RenderFetch(kind PpuFetch, addr uint16, val uint8, dot uint64) uint8
+}
+
+// Implemented by mappers that watch CPU writes to the PPU registers, as MMC5
+// does to learn the sprite size and when rendering stops
+type PpuRegisterMapper interface {
+	PpuRegisterWrite(addr uint16, val uint8)
+}
+
 func NewMapper(rom *Rom) Mapper {
 	switch rom.Mapper() {
 	case 0:
 		return NewNrom(rom)
 	case 1:
 		return NewMmc1(rom)
+	case 2:
+		return NewUxrom(rom)
+	case 3:
+		return NewCnrom(rom)
+	case 4:
+		return NewMmc3(rom)
+	case 5:
+		return NewMmc5(rom)
+	case 7:
+		return NewAxrom(rom)
+	case 9:
+		return NewMmc2(rom, false)
+	case 10:
+		return NewMmc2(rom, true)
+	case 11:
+		return NewColorDreams(rom)
+	case 21, 22, 23, 25:
+		return NewVrc4(rom)
+	case 24:
+		return NewVrc6(rom, false)
+	case 26:
+		return NewVrc6(rom, true)
+	case 66:
+		return NewGxrom(rom)
+	case 69:
+		return NewFme7(rom)
+	case 85:
+		return NewVrc7(rom)
 	}
 	panic(fmt.Sprintf("Unimplemented mapper %v", rom.Mapper()))
 }
 
+// Returns the byte at addr within a bank of data, wrapping banks beyond the end
+func loadBanked(data []uint8, bank int, bankSize int, addr uint16) uint8 {
+	return data[(bank*bankSize)%len(data)+int(addr)&(bankSize-1)]
+}
+
 // NROM: No mapping capability
 type Nrom struct {
 	rom    *Rom
@@ -60,7 +150,12 @@ func (nrom *Nrom) StoreChr(addr uint16, val uint8) {
 }
 
 func (nrom *Nrom) Mirroring() Mirroring {
-	if nrom.rom.header.Flags6&0x1 == 0 {
+	return solderedMirroring(nrom.rom)
+}
+
+// Returns the mirroring fixed by the board wiring, for mappers without control
+func solderedMirroring(rom *Rom) Mirroring {
+	if rom.header.Flags6&0x1 == 0 {
 		return MirrorHorizontal
 	}
 	return MirrorVertical
@@ -0,0 +1,481 @@
+package main
+
+import "testing"
+
+func newTestRom(prgBanks, chrBanks int) *Rom {
+	rom := &Rom{prg: make([]byte, prgBanks*0x4000), chr: make([]byte, chrBanks*0x2000)}
+	rom.header.PrgRom16kBanks = uint8(prgBanks)
+	rom.header.ChrRom8kBanks = uint8(chrBanks)
+	return rom
+}
+
+func TestVrc6Saw(t *testing.T) {
+	vrc6 := NewVrc6(newTestRom(2, 1), false)
+	vrc6.StorePrg(0xb000, 8)    // Rate
+	vrc6.StorePrg(0xb001, 0)    // Period
+	vrc6.StorePrg(0xb002, 0x80) // Enable
+
+	// The accumulator adds the rate every other step and resets after 14 steps
+	for i := 0; i < 12; i++ {
+		vrc6.ClockAudio()
+	}
+	if out := vrc6.saw.output(); out != 6 {
+		t.Errorf("Saw output %d after 12 steps, expected 6", out)
+	}
+	vrc6.ClockAudio()
+	vrc6.ClockAudio()
+	if out := vrc6.saw.output(); out != 0 {
+		t.Errorf("Saw output %d after 14 steps, expected 0", out)
+	}
+
+	// Mapper 26 swaps A0 and A1
+	vrc6 = NewVrc6(newTestRom(2, 1), true)
+	vrc6.StorePrg(0xb002, 0x12)
+	if vrc6.saw.period != 0x12 {
+		t.Errorf("Mapper 26 period %#x, expected 0x12", vrc6.saw.period)
+	}
+}
+
+func TestFme7Irq(t *testing.T) {
+	fme7 := NewFme7(newTestRom(2, 1))
+	fme7.StorePrg(0x8000, 0xe)
+	fme7.StorePrg(0xa000, 3)
+	fme7.StorePrg(0x8000, 0xf)
+	fme7.StorePrg(0xa000, 0)
+	fme7.StorePrg(0x8000, 0xd)
+	fme7.StorePrg(0xa000, 0x81)
+
+	// The IRQ fires when the counter wraps from 0 to 0xffff
+	for i := 0; i < 3; i++ {
+		fme7.ClockCpu()
+	}
+	if fme7.Irq() {
+		t.Fatal("IRQ before counter wrapped")
+	}
+	fme7.ClockCpu()
+	if !fme7.Irq() {
+		t.Fatal("No IRQ after counter wrapped")
+	}
+
+	fme7.StorePrg(0xa000, 0x81)
+	if fme7.Irq() {
+		t.Error("IRQ not acknowledged by writing command d")
+	}
+}
+
+func TestMmc3Banking(t *testing.T) {
+	rom := newTestRom(4, 2) // 8 PRG banks, 16 CHR banks
+	for bank := 0; bank < 8; bank++ {
+		rom.prg[bank*0x2000] = uint8(bank)
+	}
+	for bank := 0; bank < 16; bank++ {
+		rom.chr[bank*0x400] = uint8(bank)
+	}
+	mmc3 := NewMmc3(rom)
+	for reg, bank := range []uint8{2, 4, 8, 9, 10, 11, 1, 3} {
+		mmc3.StorePrg(0x8000, uint8(reg))
+		mmc3.StorePrg(0x8001, bank)
+	}
+
+	for i, expected := range []uint8{1, 3, 6, 7} {
+		if got := mmc3.LoadPrg(0x8000 + uint16(i)*0x2000); got != expected {
+			t.Errorf("PRG slot %d bank %d, expected %d", i, got, expected)
+		}
+	}
+	for i, expected := range []uint8{2, 3, 4, 5, 8, 9, 10, 11} {
+		if got := mmc3.LoadChr(uint16(i) * 0x400); got != expected {
+			t.Errorf("CHR slot %d bank %d, expected %d", i, got, expected)
+		}
+	}
+
+	// Invert both modes
+	mmc3.StorePrg(0x8000, 0xc0)
+	for i, expected := range []uint8{6, 3, 1, 7} {
+		if got := mmc3.LoadPrg(0x8000 + uint16(i)*0x2000); got != expected {
+			t.Errorf("Inverted PRG slot %d bank %d, expected %d", i, got, expected)
+		}
+	}
+	for i, expected := range []uint8{8, 9, 10, 11, 2, 3, 4, 5} {
+		if got := mmc3.LoadChr(uint16(i) * 0x400); got != expected {
+			t.Errorf("Inverted CHR slot %d bank %d, expected %d", i, got, expected)
+		}
+	}
+
+	// PRG RAM works before the game writes 0xa001
+	mmc3.StorePrg(0x6000, 0x42)
+	if got := mmc3.LoadPrg(0x6000); got != 0x42 {
+		t.Errorf("PRG RAM %#x, expected 0x42", got)
+	}
+}
+
+func TestMmc3ScanlineIrq(t *testing.T) {
+	rom := newTestRom(2, 1)
+	mmc3 := NewMmc3(rom)
+	ppu := &Ppu{vram: NewVramMemoryMap(mmc3)}
+	ppu.Setup()
+	ppu.writeCtrl(0x08) // Sprites from 0x1000
+	ppu.writeMask(0x18)
+
+	mmc3.StorePrg(0xc000, 9)
+	mmc3.StorePrg(0xc001, 0)
+	mmc3.StorePrg(0xe001, 0)
+
+	// The counter reloads on the pre-render scanline and counts down on each
+	// visible scanline's sprite fetches
+	stepPpuTo(ppu, 8, 0)
+	if mmc3.Irq() {
+		t.Fatal("IRQ before scanline 8")
+	}
+	stepPpuTo(ppu, 9, 0)
+	if !mmc3.Irq() {
+		t.Fatal("No IRQ after scanline 8")
+	}
+
+	mmc3.StorePrg(0xe000, 0)
+	if mmc3.Irq() {
+		t.Error("IRQ not acknowledged")
+	}
+}
+
+func TestUxromBusConflicts(t *testing.T) {
+	rom := newTestRom(8, 0)
+	for bank := 0; bank < 8; bank++ {
+		rom.prg[bank*0x4000] = uint8(bank)
+	}
+	rom.prg[len(rom.prg)-1] = 0x06 // In the fixed bank
+
+	uxrom := NewUxrom(rom)
+	uxrom.StorePrg(0xffff, 0x05) // Conflicts with 0x06 in ROM
+	if got := uxrom.LoadPrg(0x8000); got != 4 {
+		t.Errorf("Bank after conflicting write %d, expected 4", got)
+	}
+	if got := uxrom.LoadPrg(0xc000); got != 7 {
+		t.Errorf("Fixed bank %d, expected 7", got)
+	}
+
+	rom.header.Flags7 = 0x08 // NES 2.0
+	rom.header.PrgRam8kBanks = 0x10
+	uxrom = NewUxrom(rom)
+	uxrom.StorePrg(0xffff, 0x05)
+	if got := uxrom.LoadPrg(0x8000); got != 5 {
+		t.Errorf("Submapper 1 bank %d, expected 5", got)
+	}
+}
+
+func TestAxromMirroring(t *testing.T) {
+	axrom := NewAxrom(newTestRom(8, 0))
+	axrom.StorePrg(0x8000, 0x13)
+	if got := axrom.Mirroring(); got != MirrorSingleLower {
+		t.Errorf("Mirroring %#x, expected single lower", got)
+	}
+	if axrom.bank&7 != 3 {
+		t.Errorf("Bank %d, expected 3", axrom.bank&7)
+	}
+	axrom.StorePrg(0x8000, 0x03)
+	if got := axrom.Mirroring(); got != MirrorSingleUpper {
+		t.Errorf("Mirroring %#x, expected single upper", got)
+	}
+}
+
+func TestMmc2Latches(t *testing.T) {
+	rom := newTestRom(8, 4) // 32 CHR banks of 4 KB
+	for bank := 0; bank < 8; bank++ {
+		rom.chr[bank*0x1000] = uint8(bank)
+	}
+	mmc2 := NewMmc2(rom, false)
+	for reg, bank := range []uint8{1, 2, 3, 4} {
+		mmc2.StorePrg(0xb000+uint16(reg)*0x1000, bank)
+	}
+
+	mmc2.PpuAddress(0x0fd9, 0) // Only the first row triggers in the lower half
+	mmc2.PpuAddress(0x1fdf, 0)
+	if got := mmc2.LoadChr(0); got != 2 {
+		t.Errorf("Lower half bank %d, expected 2", got)
+	}
+	if got := mmc2.LoadChr(0x1000); got != 3 {
+		t.Errorf("Upper half bank %d, expected 3", got)
+	}
+	mmc2.PpuAddress(0x0fd8, 0)
+	mmc2.PpuAddress(0x1fe8, 0)
+	if got := mmc2.LoadChr(0); got != 1 {
+		t.Errorf("Lower half after 0xfd bank %d, expected 1", got)
+	}
+	if got := mmc2.LoadChr(0x1000); got != 4 {
+		t.Errorf("Upper half after 0xfe bank %d, expected 4", got)
+	}
+
+	mmc4 := NewMmc2(rom, true)
+	mmc4.StorePrg(0xb000, 5)
+	mmc4.PpuAddress(0x0fdc, 0)
+	if got := mmc4.LoadChr(0); got != 5 {
+		t.Errorf("MMC4 lower half bank %d, expected 5", got)
+	}
+}
+
+func TestMmc5Banking(t *testing.T) {
+	rom := newTestRom(8, 2) // 16 PRG banks, 16 CHR banks
+	for bank := 0; bank < 16; bank++ {
+		rom.prg[bank*0x2000] = uint8(bank)
+		rom.chr[bank*0x400] = uint8(bank)
+	}
+	mmc5 := NewMmc5(rom)
+
+	// 0x5117 selects ROM even without bit 7, wherever its banks are mapped
+	mmc5.StorePrg(0x5117, 0x0f)
+	mmc5.StorePrg(0x5100, 0) // 32 KB
+	for i, expected := range []uint8{12, 13, 14, 15} {
+		if got := mmc5.LoadPrg(0x8000 + uint16(i)*0x2000); got != expected {
+			t.Errorf("32 KB mode PRG slot %d bank %d, expected %d", i, got, expected)
+		}
+	}
+	mmc5.StorePrg(0x5100, 1) // 16 KB + 16 KB
+	mmc5.StorePrg(0x5115, 0x85)
+	for i, expected := range []uint8{4, 5, 14, 15} {
+		if got := mmc5.LoadPrg(0x8000 + uint16(i)*0x2000); got != expected {
+			t.Errorf("16 KB mode PRG slot %d bank %d, expected %d", i, got, expected)
+		}
+	}
+
+	mmc5.StorePrg(0x5100, 2) // 16 KB + 8 KB + 8 KB
+	mmc5.StorePrg(0x5115, 0x85)
+	mmc5.StorePrg(0x5116, 0x89)
+	for i, expected := range []uint8{4, 5, 9, 15} {
+		if got := mmc5.LoadPrg(0x8000 + uint16(i)*0x2000); got != expected {
+			t.Errorf("PRG slot %d bank %d, expected %d", i, got, expected)
+		}
+	}
+
+	// PRG RAM at 0xc000 takes writes once unprotected
+	mmc5.StorePrg(0x5116, 0x01)
+	mmc5.StorePrg(0xc000, 0x42)
+	if got := mmc5.LoadPrg(0xc000); got != 0 {
+		t.Errorf("Protected RAM %#x, expected 0", got)
+	}
+	mmc5.StorePrg(0x5102, 2)
+	mmc5.StorePrg(0x5103, 1)
+	mmc5.StorePrg(0xc000, 0x42)
+	if got := mmc5.LoadPrg(0xc000); got != 0x42 {
+		t.Errorf("Unprotected RAM %#x, expected 0x42", got)
+	}
+
+	// In 8x16 mode sprites use set A and the background set B
+	mmc5.StorePrg(0x5101, 3) // 1 KB
+	mmc5.StorePrg(0x5120, 6)
+	mmc5.StorePrg(0x5128, 12)
+	mmc5.PpuRegisterWrite(0x2000, 0x20)
+	if got := mmc5.RenderFetch(PpuFetchSprite, 0, 0, 0); got != 6 {
+		t.Errorf("Sprite bank %d, expected 6", got)
+	}
+	if got := mmc5.RenderFetch(PpuFetchBackground, 0x1000, 0, 0); got != 12 {
+		t.Errorf("Background bank %d, expected 12", got)
+	}
+	if got := mmc5.LoadChr(0); got != 12 {
+		t.Errorf("PPUDATA bank %d, expected last written 12", got)
+	}
+
+	mmc5.StorePrg(0x5205, 200)
+	mmc5.StorePrg(0x5206, 100)
+	if got := uint16(mmc5.LoadPrg(0x5206))<<8 | uint16(mmc5.LoadPrg(0x5205)); got != 20000 {
+		t.Errorf("Product %d, expected 20000", got)
+	}
+}
+
+func TestMmc5Nametables(t *testing.T) {
+	mmc5 := NewMmc5(newTestRom(2, 1))
+	ppu := &Ppu{vram: NewVramMemoryMap(mmc5)}
+	ppu.Setup()
+	mmc5.StorePrg(0x5105, 0xe4) // CIRAM, CIRAM, ExRAM, fill
+	mmc5.StorePrg(0x5106, 0x21)
+	mmc5.StorePrg(0x5107, 2)
+	ppu.vram.updateMirroring()
+
+	ppu.vram.Store(0x2805, 0x33)
+	if got := mmc5.exRam[5]; got != 0x33 {
+		t.Errorf("ExRAM %#x, expected 0x33", got)
+	}
+	if got := ppu.vram.Load(0x2c05); got != 0x21 {
+		t.Errorf("Fill tile %#x, expected 0x21", got)
+	}
+	if got := ppu.vram.Load(0x2fc5); got != 0xaa {
+		t.Errorf("Fill attribute %#x, expected 0xaa", got)
+	}
+}
+
+func TestMmc5ScanlineIrq(t *testing.T) {
+	mmc5 := NewMmc5(newTestRom(2, 1))
+	ppu := &Ppu{vram: NewVramMemoryMap(mmc5)}
+	ppu.Setup()
+	ppu.writeMask(0x18)
+	mmc5.StorePrg(0x5203, 10)
+	mmc5.StorePrg(0x5204, 0x80)
+
+	// Scanlines are detected on their first dot
+	stepPpuTo(ppu, 10, 1)
+	if mmc5.Irq() {
+		t.Fatal("IRQ before scanline 10")
+	}
+	stepPpuTo(ppu, 10, 2)
+	if !mmc5.Irq() {
+		t.Fatal("No IRQ on scanline 10")
+	}
+	if got := mmc5.LoadPrg(0x5204); got != 0xc0 {
+		t.Errorf("Status %#x, expected 0xc0", got)
+	}
+	if mmc5.Irq() {
+		t.Fatal("IRQ not acknowledged by reading the status")
+	}
+
+	// Without NMIs, the fetches stopping in vblank still end the frame
+	stepPpuTo(ppu, 10, 1)
+	if mmc5.Irq() {
+		t.Fatal("IRQ before scanline 10 of the second frame")
+	}
+	stepPpuTo(ppu, 10, 2)
+	if !mmc5.Irq() {
+		t.Error("No IRQ on scanline 10 of the second frame")
+	}
+}
+
+func TestVrc4AddressLines(t *testing.T) {
+	rom := newTestRom(8, 32)
+	for bank := 0; bank < 256; bank++ {
+		rom.chr[bank*0x400] = uint8(bank)
+	}
+
+	// VRC4b and VRC4d share mapper 25 with A0 and A1 swapped, and A2 and A3
+	rom.header.Flags6 = 0x90
+	rom.header.Flags7 = 0x10
+	vrc4 := NewVrc4(rom)
+	vrc4.StorePrg(0xb000, 0x5) // Bank 0 low
+	vrc4.StorePrg(0xb001, 0x5) // Bank 1 low on VRC4b
+	vrc4.StorePrg(0xb00c, 0x1) // Bank 1 high on VRC4d
+	if got := vrc4.LoadChr(0); got != 5 {
+		t.Errorf("Bank 0 %d, expected 5", got)
+	}
+	if got := vrc4.LoadChr(0x400); got != 0x15 {
+		t.Errorf("Bank 1 %#x, expected 0x15", got)
+	}
+
+	// With submapper 2, only A2 and A3 decode the register
+	rom.header.Flags7 = 0x18
+	rom.header.PrgRam8kBanks = 0x20
+	vrc4 = NewVrc4(rom)
+	vrc4.StorePrg(0xb001, 0x7)
+	if got := vrc4.LoadChr(0); got != 7 {
+		t.Errorf("VRC4d bank 0 %d, expected 7", got)
+	}
+}
+
+func TestVrc4Irq(t *testing.T) {
+	rom := newTestRom(8, 1)
+	rom.header.Flags6 = 0x50 // Mapper 21
+	rom.header.Flags7 = 0x10
+	vrc4 := NewVrc4(rom)
+	vrc4.StorePrg(0xf000, 0xd) // Latch low nibble
+	vrc4.StorePrg(0xf002, 0xf) // Latch high nibble
+	vrc4.StorePrg(0xf004, 0x6) // Enable in cycle mode
+
+	for i := 0; i < 0x100-0xfd; i++ {
+		if vrc4.Irq() {
+			t.Fatalf("IRQ after %d cycles", i)
+		}
+		vrc4.ClockCpu()
+	}
+	if !vrc4.Irq() {
+		t.Error("No IRQ when the counter overflowed")
+	}
+}
+
+func TestVrc7Audio(t *testing.T) {
+	vrc7 := NewVrc7(newTestRom(8, 1))
+	write := func(reg, val uint8) {
+		vrc7.StorePrg(0x9010, reg)
+		vrc7.StorePrg(0x9030, val)
+	}
+	write(0x30, 0x30) // Flute at full volume
+	write(0x10, 0xac) // A440
+	write(0x20, 0x18) // Key on, octave 4
+
+	var peak float32
+	for i := 0; i < 36*2000; i++ {
+		vrc7.ClockAudio()
+		if out := vrc7.AudioOutput(); out > peak {
+			peak = out
+		}
+	}
+	if peak < 0.01 || peak > vrc7OutputScale {
+		t.Errorf("Peak output %v, expected within (0.01, %v]", peak, vrc7OutputScale)
+	}
+
+	// Reset silences the channels
+	vrc7.StorePrg(0xe000, 0x40)
+	vrc7.StorePrg(0xe000, 0)
+	for i := 0; i < 36; i++ {
+		vrc7.ClockAudio()
+	}
+	if out := vrc7.AudioOutput(); out != 0 {
+		t.Errorf("Output after reset %v, expected 0", out)
+	}
+}
+
+func TestVrc7bAudioPorts(t *testing.T) {
+	rom := newTestRom(8, 1)
+	for bank := 0; bank < 16; bank++ {
+		rom.prg[bank*0x2000] = uint8(bank)
+	}
+	rom.header.Flags6 = 0x50 // Mapper 85
+	rom.header.Flags7 = 0x58
+	rom.header.PrgRam8kBanks = 0x10 // Submapper 1, VRC7b
+	vrc7 := NewVrc7(rom)
+
+	// VRC7b moves register bit 4 to A3, but the audio ports stay on A4 and A5
+	vrc7.StorePrg(0x9000, 3)
+	vrc7.StorePrg(0x9010, 0x10)
+	vrc7.StorePrg(0x9030, 0xac)
+	if got := vrc7.LoadPrg(0xc000); got != 3 {
+		t.Errorf("PRG bank at 0xc000 %d after audio writes, expected 3", got)
+	}
+	if fnum := vrc7.audio.channels[0].fnum; fnum != 0xac {
+		t.Errorf("Channel 0 F-number %#x, expected 0xac", fnum)
+	}
+}
+
+func TestVrc2Mirroring(t *testing.T) {
+	rom := newTestRom(8, 1)
+	for bank := 0; bank < 16; bank++ {
+		rom.prg[bank*0x2000] = uint8(bank)
+	}
+	rom.header.Flags6 = 0x70 // Mapper 23
+	rom.header.Flags7 = 0x18
+	rom.header.PrgRam8kBanks = 0x30 // Submapper 3, VRC2b
+
+	// VRC2 has only a 1-bit mirroring register at 0x9000-0x9003 and no PRG
+	// swap mode
+	vrc2 := NewVrc4(rom)
+	vrc2.StorePrg(0x8000, 2)
+	vrc2.StorePrg(0x9002, 0x03)
+	if got := vrc2.Mirroring(); got != MirrorHorizontal {
+		t.Errorf("VRC2b mirroring %#x, expected horizontal", got)
+	}
+	if got := vrc2.LoadPrg(0x8000); got != 2 {
+		t.Errorf("VRC2b bank at 0x8000 %d, expected 2", got)
+	}
+
+	// Without a submapper, VRC2b writes on A0 and A1 still set the mirroring,
+	// and VRC4e writes on A2 and A3 the PRG swap mode
+	rom.header.Flags7 = 0x10
+	rom.header.PrgRam8kBanks = 0
+	vrc4 := NewVrc4(rom)
+	vrc4.StorePrg(0x8000, 2)
+	vrc4.StorePrg(0x9002, 0x03)
+	if got := vrc4.Mirroring(); got != MirrorHorizontal {
+		t.Errorf("Mapper 23 mirroring %#x after VRC2b write, expected horizontal", got)
+	}
+	if got := vrc4.LoadPrg(0x8000); got != 2 {
+		t.Errorf("Mapper 23 bank at 0x8000 %d after VRC2b write, expected 2", got)
+	}
+	vrc4.StorePrg(0x9008, 0x02)
+	if got := vrc4.LoadPrg(0xc000); got != 2 {
+		t.Errorf("Mapper 23 bank at 0xc000 %d after VRC4e write, expected 2", got)
+	}
+}
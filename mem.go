@@ -8,6 +8,13 @@ type MemoryMap struct {
 	apu    *Apu
 	input  *Input
 	mapper Mapper
+
+	registerMapper PpuRegisterMapper // Optional
+
+	oamDmaEnd uint64 // CPU cycle at which the last OAM DMA completes
+
+	// Catches the PPU up to the current CPU cycle before register accesses, if set
+	syncPpu func()
 }
 
 func (mem *MemoryMap) Load(addr uint16) uint8 {
@@ -15,6 +22,9 @@ func (mem *MemoryMap) Load(addr uint16) uint8 {
 	case addr < 0x2000:
 		return mem.ram[addr&0x7ff]
 	case addr < 0x4000:
+		if mem.syncPpu != nil {
+			mem.syncPpu()
+		}
 		return mem.ppu.Load(addr)
 	case addr < 0x4016:
 		return mem.apu.Load(addr)
@@ -29,7 +39,13 @@ func (mem *MemoryMap) Store(addr uint16, val uint8) {
 	case addr < 0x2000:
 		mem.ram[addr&0x7ff] = val
 	case addr < 0x4000:
+		if mem.syncPpu != nil {
+			mem.syncPpu()
+		}
 		mem.ppu.Store(addr, val)
+		if mem.registerMapper != nil {
+			mem.registerMapper.PpuRegisterWrite(0x2000|addr&7, val)
+		}
 	case addr == 0x4014:
 		dma(mem, val)
 	case addr == 0x4016:
@@ -38,6 +54,10 @@ func (mem *MemoryMap) Store(addr uint16, val uint8) {
 		mem.apu.Store(addr, val)
 	default:
 		mem.mapper.StorePrg(addr, val)
+		// Mappers switch mirroring through their registers, never in PRG RAM
+		if mem.ppu != nil && (addr < 0x6000 || addr >= 0x8000) {
+			mem.ppu.vram.updateMirroring()
+		}
 	}
 }
 
@@ -46,8 +66,26 @@ func dma(mem *MemoryMap, addrHigh uint8) {
 		addr := uint16(addrHigh)<<8 | uint16(addrLow)
 		mem.Store(0x2004, mem.Load(addr))
 	}
-	// FIXME: Not entirely cycle accurate--starting OAM DMA on CPU read beat (odd
-	// cycle) adds an extra cycle to the CPU idle time. Moreover there are
-	// complications with APU DMC DMA and cycle stealing.
-	mem.cpu.Idle(513)
+
+	// The DMA starts once the (almost always 4-cycle absolute) store completes,
+	// and starting on an odd cycle costs an extra cycle to align with the reads
+	start := mem.cpu.cycles + 4
+	cycles := 513
+	if start&1 == 1 {
+		cycles++
+	}
+	mem.cpu.Idle(cycles)
+	mem.oamDmaEnd = start + uint64(cycles)
+}
+
+// Fetches a DMC sample byte on behalf of the APU, stalling the CPU while the DMC
+// holds the bus. A fetch during OAM DMA only steals two cycles because the CPU is
+// already halted.
+func dmcDma(mem *MemoryMap, addr uint16, cycle uint64) uint8 {
+	stall := 4
+	if cycle < mem.oamDmaEnd {
+		stall = 2
+	}
+	mem.cpu.Idle(stall)
+	return mem.Load(addr)
 }
@@ -0,0 +1,68 @@
+package main
+
+import "fmt"
+
+// Combines the APU channels with the non-linear response of the NES DACs. The
+// pulse channels share one DAC and the triangle, noise and DMC channels share
+// another, so channels within a group attenuate each other as they get louder.
+// Cartridge expansion audio is mixed in linearly.
+type ApuMixer struct {
+	volume [ChannelMax]float32
+	muted  [ChannelMax]bool
+}
+
+// APU channels in mixer order
+const (
+	ChannelPulse1 = iota
+	ChannelPulse2
+	ChannelTriangle
+	ChannelNoise
+	ChannelDmc
+	ChannelExpansion
+	ChannelMax
+)
+
+var channelNames = [ChannelMax]string{"pulse1", "pulse2", "triangle", "noise", "dmc", "expansion"}
+
+func NewApuMixer() ApuMixer {
+	mixer := ApuMixer{}
+	for ch := range mixer.volume {
+		mixer.volume[ch] = 1
+	}
+	return mixer
+}
+
+// Returns the channel with the given name, e.g. "triangle"
+func ParseChannel(name string) (int, error) {
+	for ch, channelName := range channelNames {
+		if name == channelName {
+			return ch, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown channel %q", name)
+}
+
+func (mixer *ApuMixer) SetVolume(ch int, volume float32) { mixer.volume[ch] = volume }
+func (mixer *ApuMixer) SetMuted(ch int, muted bool)      { mixer.muted[ch] = muted }
+func (mixer *ApuMixer) Muted(ch int) bool                { return mixer.muted[ch] }
+
+// Returns the mixed output, about [0, 1] without expansion audio, for the raw
+// channel levels (0-15 for pulse, triangle and noise, 0-127 for DMC) and the
+// expansion output
+func (mixer *ApuMixer) mix(levels [ChannelMax]float32) float32 {
+	var in [ChannelMax]float32
+	for ch, level := range levels {
+		if !mixer.muted[ch] {
+			in[ch] = level * mixer.volume[ch]
+		}
+	}
+
+	var pulse, tnd float32
+	if sum := in[ChannelPulse1] + in[ChannelPulse2]; sum > 0 {
+		pulse = 95.88 / (8128/sum + 100)
+	}
+	if sum := in[ChannelTriangle]/8227 + in[ChannelNoise]/12241 + in[ChannelDmc]/22638; sum > 0 {
+		tnd = 159.79 / (1/sum + 100)
+	}
+	return pulse + tnd + in[ChannelExpansion]
+}
@@ -0,0 +1,98 @@
+package main
+
+// MMC2 / PxROM (mapper 9) and MMC4 / FxROM (mapper 10). Each 4 KB half of CHR
+// has two banks, and a latch picks between them when the PPU reads tile 0xfd
+// or 0xfe, so a tile at the edge of an area can switch the graphics below it.
+type Mmc2 struct {
+	rom *Rom
+
+	// MMC4 has 16 KB PRG banks, PRG RAM, and wider latch triggers
+	mmc4   bool
+	prgRam []uint8
+
+	// Registers
+	prgBank   uint8       // 0xa000-0xafff
+	chrBanks  [2][2]uint8 // 0xb000-0xefff: 4 KB banks by half and latch
+	mirroring uint8       // 0xf000-0xffff
+
+	latches [2]uint8 // 0: 0xfd, 1: 0xfe
+}
+
+func NewMmc2(rom *Rom, mmc4 bool) *Mmc2 {
+	return &Mmc2{
+		rom:     rom,
+		mmc4:    mmc4,
+		prgRam:  make([]uint8, 8192),
+		latches: [2]uint8{1, 1}}
+}
+
+func (mmc2 *Mmc2) LoadPrg(addr uint16) uint8 {
+	switch {
+	case addr < 0x6000:
+		return 0
+	case addr < 0x8000:
+		if !mmc2.mmc4 {
+			return 0
+		}
+		return mmc2.prgRam[addr-0x6000]
+	case mmc2.mmc4:
+		if addr < 0xc000 {
+			return loadBanked(mmc2.rom.prg, int(mmc2.prgBank), 0x4000, addr)
+		}
+		return loadBanked(mmc2.rom.prg, len(mmc2.rom.prg)/0x4000-1, 0x4000, addr)
+	case addr < 0xa000:
+		return loadBanked(mmc2.rom.prg, int(mmc2.prgBank), 0x2000, addr)
+	}
+	// The last three 8 KB banks are fixed at 0xa000
+	return loadBanked(mmc2.rom.prg, len(mmc2.rom.prg)/0x2000-4+int(addr>>13-4), 0x2000, addr)
+}
+
+func (mmc2 *Mmc2) StorePrg(addr uint16, val uint8) {
+	switch {
+	case addr < 0x6000:
+	case addr < 0x8000:
+		if mmc2.mmc4 {
+			mmc2.prgRam[addr-0x6000] = val
+		}
+	case addr < 0xa000:
+	case addr < 0xb000:
+		mmc2.prgBank = val & 0xf
+	case addr < 0xf000:
+		reg := (addr - 0xb000) >> 12
+		mmc2.chrBanks[reg>>1][reg&1] = val & 0x1f
+	default:
+		mmc2.mirroring = val & 1
+	}
+}
+
+func (mmc2 *Mmc2) LoadChr(addr uint16) uint8 {
+	half := addr >> 12
+	return loadBanked(mmc2.rom.chr, int(mmc2.chrBanks[half][mmc2.latches[half]]), 0x1000, addr)
+}
+
+func (mmc2 *Mmc2) StoreChr(addr uint16, val uint8) {}
+
+func (mmc2 *Mmc2) Mirroring() Mirroring {
+	if mmc2.mirroring == 0 {
+		return MirrorVertical
+	}
+	return MirrorHorizontal
+}
+
+// Flips the latches after the PPU reads the second plane of tile 0xfd or
+// 0xfe. MMC2 only triggers on the first row of the tiles in the lower half.
+func (mmc2 *Mmc2) PpuAddress(addr uint16, dot uint64) {
+	if addr >= 0x2000 {
+		return
+	}
+	half := addr >> 12
+	if half == 0 && !mmc2.mmc4 && addr&7 != 0 {
+		return
+	}
+	switch addr & 0xff8 {
+	case 0xfd8:
+		mmc2.latches[half] = 0
+	case 0xfe8:
+		mmc2.latches[half] = 1
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+// MMC3 / TxROM (mapper 4)
+type Mmc3 struct {
+	rom *Rom
+
+	// RAM
+	prgRam []uint8
+	chrRam []uint8
+
+	// Registers
+	bankSelect    uint8    // 0x8000 even: bank register, PRG and CHR modes
+	banks         [8]uint8 // 0x8001 odd: R0-R1 2 KB CHR, R2-R5 1 KB CHR, R6-R7 8 KB PRG
+	mirroring     uint8    // 0xa000 even
+	prgRamProtect uint8    // 0xa001 odd: bit 7 enables, bit 6 denies writes
+
+	// Scanline counter, clocked by rises of PPU A12
+	irqLatch   uint8 // 0xc000 even
+	irqCounter uint8
+	irqReload  bool // 0xc001 odd
+	irqEnabled bool // 0xe000 even disables, 0xe001 odd enables
+	irq        bool
+	a12Dot     uint64 // PPU dot when A12 was last high
+}
+
+// A12 must stay low for a few CPU cycles before a rise clocks the counter, so
+// the sprite fetches of one scanline count only once
+const mmc3A12LowDots = 10
+
+func (mmc3 *Mmc3) prgMode() uint8 { return mmc3.bankSelect >> 6 & 1 }
+func (mmc3 *Mmc3) chrMode() uint8 { return mmc3.bankSelect >> 7 }
+
+func NewMmc3(rom *Rom) *Mmc3 {
+	return &Mmc3{
+		rom:    rom,
+		prgRam: make([]uint8, 8192),
+		chrRam: make([]uint8, 8192),
+		// Many games never write 0xa001 and expect working RAM
+		prgRamProtect: 0x80}
+}
+
+func (mmc3 *Mmc3) LoadPrg(addr uint16) uint8 {
+	if addr < 0x6000 {
+		return 0
+	}
+	if addr < 0x8000 {
+		if mmc3.prgRamProtect&0x80 == 0 {
+			return 0 // RAM disabled
+		}
+		return mmc3.prgRam[addr-0x6000]
+	}
+
+	// R6 and the second last bank swap places between 0x8000 and 0xc000
+	last := len(mmc3.rom.prg)/0x2000 - 1
+	var bank int
+	switch slot := addr >> 13; {
+	case slot == 5:
+		bank = int(mmc3.banks[7] & 0x3f)
+	case slot == 7:
+		bank = last
+	case (slot == 4) == (mmc3.prgMode() == 0):
+		bank = int(mmc3.banks[6] & 0x3f)
+	default:
+		bank = last - 1
+	}
+	return loadBanked(mmc3.rom.prg, bank, 0x2000, addr)
+}
+
+func (mmc3 *Mmc3) StorePrg(addr uint16, val uint8) {
+	switch {
+	case addr < 0x6000:
+	case addr < 0x8000:
+		if mmc3.prgRamProtect&0xc0 == 0x80 {
+			mmc3.prgRam[addr-0x6000] = val
+		}
+	case addr < 0xa000:
+		if addr&1 == 0 {
+			mmc3.bankSelect = val
+		} else {
+			mmc3.banks[mmc3.bankSelect&7] = val
+		}
+	case addr < 0xc000:
+		if addr&1 == 0 {
+			mmc3.mirroring = val & 1
+		} else {
+			mmc3.prgRamProtect = val
+		}
+	case addr < 0xe000:
+		if addr&1 == 0 {
+			mmc3.irqLatch = val
+		} else {
+			mmc3.irqCounter = 0
+			mmc3.irqReload = true
+		}
+	default:
+		mmc3.irqEnabled = addr&1 == 1
+		if !mmc3.irqEnabled {
+			mmc3.irq = false
+		}
+	}
+}
+
+func (mmc3 *Mmc3) chrBank(addr uint16) int {
+	slot := addr >> 10
+	if mmc3.chrMode() == 1 {
+		slot ^= 4 // Swap the 2 KB and 1 KB halves
+	}
+	if slot < 4 {
+		return int(mmc3.banks[slot>>1]&0xfe) | int(slot&1)
+	}
+	return int(mmc3.banks[slot-2])
+}
+
+func (mmc3 *Mmc3) LoadChr(addr uint16) uint8 {
+	if mmc3.rom.header.ChrRom8kBanks == 0 {
+		return loadBanked(mmc3.chrRam, mmc3.chrBank(addr), 0x400, addr)
+	}
+	return loadBanked(mmc3.rom.chr, mmc3.chrBank(addr), 0x400, addr)
+}
+
+func (mmc3 *Mmc3) StoreChr(addr uint16, val uint8) {
+	if mmc3.rom.header.ChrRom8kBanks == 0 {
+		mmc3.chrRam[(mmc3.chrBank(addr)*0x400)%len(mmc3.chrRam)+int(addr&0x3ff)] = val
+	}
+}
+
+func (mmc3 *Mmc3) Mirroring() Mirroring {
+	if mmc3.mirroring == 0 {
+		return MirrorVertical
+	}
+	return MirrorHorizontal
+}
+
+func (mmc3 *Mmc3) PpuAddress(addr uint16, dot uint64) {
+	if addr&0x1000 == 0 {
+		return
+	}
+	if dot-mmc3.a12Dot > mmc3A12LowDots {
+		mmc3.clockCounter()
+	}
+	mmc3.a12Dot = dot
+}
+
+func (mmc3 *Mmc3) clockCounter() {
+	if mmc3.irqCounter == 0 || mmc3.irqReload {
+		mmc3.irqCounter = mmc3.irqLatch
+		mmc3.irqReload = false
+	} else {
+		mmc3.irqCounter--
+	}
+	if mmc3.irqCounter == 0 && mmc3.irqEnabled {
+		mmc3.irq = true
+	}
+}
+
+func (mmc3 *Mmc3) Irq() bool { return mmc3.irq }
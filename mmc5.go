@@ -0,0 +1,357 @@
+package main
+
+// MMC5 / ExROM (mapper 5)
+type Mmc5 struct {
+	rom *Rom
+
+	// RAM
+	prgRam []uint8 // Up to 64 KB
+	chrRam []uint8
+	exRam  [0x400]uint8 // 0x5c00-0x5fff
+
+	// Registers
+	prgMode       uint8     // 0x5100: 32, 16, 16+8 or 8 KB banks
+	chrMode       uint8     // 0x5101: 8, 4, 2 or 1 KB banks
+	prgRamProtect [2]uint8  // 0x5102-0x5103: writes need 2 and 1
+	exRamMode     uint8     // 0x5104
+	nametables    Mirroring // 0x5105: pages 0-1 console RAM, 2 ExRAM, 3 fill
+	fillTile      uint8     // 0x5106
+	fillAttr      uint8     // 0x5107
+	prgBanks      [5]uint8  // 0x5113-0x5117: bit 7 selects ROM over RAM
+	chrA          [8]uint16 // 0x5120-0x5127: sprites in 8x16 mode
+	chrB          [4]uint16 // 0x5128-0x512b: background in 8x16 mode
+	chrUpper      uint8     // 0x5130: upper bits of the CHR bank registers
+	chrBLast      bool      // Whether set B was written last, for 8x8 mode and PPUDATA
+
+	// Vertical split
+	splitCtrl   uint8 // 0x5200: bit 7 enables, bit 6 selects the right side, bits 0-4 tile
+	splitScroll uint8 // 0x5201
+	splitBank   uint8 // 0x5202: 4 KB CHR bank
+
+	// Scanline counter
+	irqCompare uint8 // 0x5203
+	irqEnabled bool  // 0x5204
+	irqPending bool
+	inFrame    bool // Until the NMI vector fetch, rendering is disabled, or fetches pause
+	scanline   uint8
+
+	// Unsigned 8x8 multiplier
+	multiplicand uint8 // 0x5205
+	multiplier   uint8 // 0x5206
+
+	// PPU state worked out from PPU register writes and fetches
+	sprites8x16  bool   // PPUCTRL bit 5
+	lastFetch    uint16 // Address of the last rendering fetch
+	lastFetchDot uint64 // PPU dot count of the last rendering fetch
+	fetchRepeats int    // Times in a row lastFetch was fetched again
+	column       int    // Tile column of the background fetch, 0-33
+	tile         uint16 // Nametable offset of the background tile
+	inSplit      bool   // Whether the background tile is in the split region
+	splitY       int    // Vertical position in the split region
+}
+
+func NewMmc5(rom *Rom) *Mmc5 {
+	return &Mmc5{
+		rom:      rom,
+		prgRam:   make([]uint8, 0x10000),
+		chrRam:   make([]uint8, 8192),
+		prgMode:  3,
+		prgBanks: [5]uint8{4: 0xff}}
+}
+
+func (mmc5 *Mmc5) LoadPrg(addr uint16) uint8 {
+	switch {
+	case addr >= 0x5c00 && addr < 0x6000:
+		if mmc5.exRamMode < 2 {
+			return 0 // Not readable by the CPU
+		}
+		return mmc5.exRam[addr-0x5c00]
+	case addr == 0x5204:
+		var status uint8
+		if mmc5.irqPending {
+			status |= 0x80
+		}
+		if mmc5.inFrame {
+			status |= 0x40
+		}
+		mmc5.irqPending = false
+		return status
+	case addr == 0x5205:
+		return uint8(uint16(mmc5.multiplicand) * uint16(mmc5.multiplier))
+	case addr == 0x5206:
+		return uint8(uint16(mmc5.multiplicand) * uint16(mmc5.multiplier) >> 8)
+	case addr < 0x6000:
+		return 0
+	case addr == NmiVector || addr == NmiVector+1:
+		// Fetching the NMI vector marks the end of the frame
+		mmc5.endFrame()
+	}
+
+	bank, rom := mmc5.prgBank(addr)
+	if rom {
+		return loadBanked(mmc5.rom.prg, bank, 0x2000, addr)
+	}
+	return loadBanked(mmc5.prgRam, bank, 0x2000, addr)
+}
+
+func (mmc5 *Mmc5) StorePrg(addr uint16, val uint8) {
+	switch {
+	case addr >= 0x5c00 && addr < 0x6000:
+		if mmc5.exRamMode != 3 {
+			mmc5.exRam[addr-0x5c00] = val
+		}
+	case addr < 0x6000:
+		mmc5.writeRegister(addr, val)
+	default:
+		bank, rom := mmc5.prgBank(addr)
+		if !rom && mmc5.prgRamProtect == [2]uint8{2, 1} {
+			mmc5.prgRam[(bank*0x2000)%len(mmc5.prgRam)+int(addr&0x1fff)] = val
+		}
+	}
+}
+
+func (mmc5 *Mmc5) writeRegister(addr uint16, val uint8) {
+	switch {
+	case addr == 0x5100:
+		mmc5.prgMode = val & 3
+	case addr == 0x5101:
+		mmc5.chrMode = val & 3
+	case addr == 0x5102 || addr == 0x5103:
+		mmc5.prgRamProtect[addr-0x5102] = val & 3
+	case addr == 0x5104:
+		mmc5.exRamMode = val & 3
+	case addr == 0x5105:
+		mmc5.nametables = Mirroring(val)
+	case addr == 0x5106:
+		mmc5.fillTile = val
+	case addr == 0x5107:
+		mmc5.fillAttr = val & 3
+	case addr >= 0x5113 && addr <= 0x5117:
+		mmc5.prgBanks[addr-0x5113] = val
+	case addr >= 0x5120 && addr <= 0x5127:
+		mmc5.chrA[addr-0x5120] = uint16(mmc5.chrUpper)<<8 | uint16(val)
+		mmc5.chrBLast = false
+	case addr >= 0x5128 && addr <= 0x512b:
+		mmc5.chrB[addr-0x5128] = uint16(mmc5.chrUpper)<<8 | uint16(val)
+		mmc5.chrBLast = true
+	case addr == 0x5130:
+		mmc5.chrUpper = val & 3
+	case addr == 0x5200:
+		mmc5.splitCtrl = val
+	case addr == 0x5201:
+		mmc5.splitScroll = val
+	case addr == 0x5202:
+		mmc5.splitBank = val
+	case addr == 0x5203:
+		mmc5.irqCompare = val
+	case addr == 0x5204:
+		mmc5.irqEnabled = val&0x80 == 0x80
+	case addr == 0x5205:
+		mmc5.multiplicand = val
+	case addr == 0x5206:
+		mmc5.multiplier = val
+	}
+}
+
+// Returns the 8 KB bank mapped at addr and whether it is ROM
+func (mmc5 *Mmc5) prgBank(addr uint16) (int, bool) {
+	if addr < 0x8000 {
+		return int(mmc5.prgBanks[0] & 7), false
+	}
+
+	slot := int(addr-0x8000) >> 13
+	var index int // Of the register in prgBanks
+	var reg uint8
+	switch mmc5.prgMode {
+	case 0: // 32 KB from 0x5117
+		index = 4
+		reg = mmc5.prgBanks[index]&0xfc | uint8(slot)
+	case 1: // 16 KB from 0x5115 and 0x5117
+		index = 2 + slot&2
+		reg = mmc5.prgBanks[index]&0xfe | uint8(slot&1)
+	case 2: // 16 KB from 0x5115, 8 KB from 0x5116 and 0x5117
+		if slot < 2 {
+			index = 2
+			reg = mmc5.prgBanks[index]&0xfe | uint8(slot)
+		} else {
+			index = 1 + slot
+			reg = mmc5.prgBanks[index]
+		}
+	case 3: // 8 KB from each of 0x5114-0x5117
+		index = 1 + slot
+		reg = mmc5.prgBanks[index]
+	}
+	// 0x5117 always selects ROM
+	return int(reg & 0x7f), reg&0x80 == 0x80 || index == 4
+}
+
+// Returns the 1 KB CHR bank mapped at addr by set A or B. Set B only has
+// registers for 4 KB, which repeat in both halves.
+func (mmc5 *Mmc5) chrBank(addr uint16, setB bool) int {
+	slot := int(addr >> 10)
+	size := 8 >> mmc5.chrMode // In 1 KB banks
+	reg := slot/size*size + size - 1
+	bank := mmc5.chrA[reg]
+	if setB {
+		bank = mmc5.chrB[reg&3]
+	}
+	return int(bank)*size + slot%size
+}
+
+func (mmc5 *Mmc5) chr() []uint8 {
+	if mmc5.rom.header.ChrRom8kBanks == 0 {
+		return mmc5.chrRam
+	}
+	return mmc5.rom.chr
+}
+
+func (mmc5 *Mmc5) LoadChr(addr uint16) uint8 {
+	return loadBanked(mmc5.chr(), mmc5.chrBank(addr, mmc5.chrBLast), 0x400, addr)
+}
+
+func (mmc5 *Mmc5) StoreChr(addr uint16, val uint8) {
+	if mmc5.rom.header.ChrRom8kBanks == 0 {
+		mmc5.chrRam[(mmc5.chrBank(addr, mmc5.chrBLast)*0x400)%len(mmc5.chrRam)+int(addr&0x3ff)] = val
+	}
+}
+
+func (mmc5 *Mmc5) Mirroring() Mirroring { return mmc5.nametables }
+
+// Serves ExRAM as page 2 and the fill tile and attribute as page 3
+func (mmc5 *Mmc5) LoadNametable(page int, addr uint16) uint8 {
+	switch {
+	case page == 2 && mmc5.exRamMode < 2:
+		return mmc5.exRam[addr&0x3ff]
+	case page == 2:
+		return 0
+	case addr&0x3ff < 0x3c0:
+		return mmc5.fillTile
+	}
+	return mmc5.fillAttr * 0x55
+}
+
+func (mmc5 *Mmc5) StoreNametable(page int, addr uint16, val uint8) {
+	if page == 2 && mmc5.exRamMode < 2 {
+		mmc5.exRam[addr&0x3ff] = val
+	}
+}
+
+func (mmc5 *Mmc5) PpuRegisterWrite(addr uint16, val uint8) {
+	switch addr {
+	case 0x2000:
+		mmc5.sprites8x16 = val&0x20 == 0x20
+	case 0x2001:
+		if val&0x18 == 0 {
+			mmc5.endFrame()
+		}
+	}
+}
+
+func (mmc5 *Mmc5) RenderFetch(kind PpuFetch, addr uint16, val uint8, dot uint64) uint8 {
+	// The frame ended if the PPU stopped fetching for 3 CPU cycles, as it does
+	// in vblank, so games without NMIs still have the counter reset
+	if dot-mmc5.lastFetchDot > mmc5IdleDots {
+		mmc5.endFrame()
+	}
+	mmc5.lastFetchDot = dot
+
+	// The PPU fetches the same nametable byte three times in a row only at the
+	// start of a scanline: twice at the end of the previous one and once for
+	// its third tile
+	if addr == mmc5.lastFetch {
+		mmc5.fetchRepeats++
+	} else {
+		mmc5.fetchRepeats = 0
+	}
+	mmc5.lastFetch = addr
+
+	switch kind {
+	case PpuFetchNametable:
+		mmc5.column++
+		if mmc5.fetchRepeats == 2 {
+			mmc5.countScanline()
+			mmc5.column = 2
+		}
+		mmc5.tile = addr & 0x3ff
+		mmc5.inSplit = mmc5.splitColumn(mmc5.column)
+		if mmc5.inSplit {
+			// The first two tiles are fetched on the scanline before
+			line := int(mmc5.scanline)
+			if mmc5.column < 2 {
+				line++
+				if !mmc5.inFrame {
+					line = 0
+				}
+			}
+			mmc5.splitY = (int(mmc5.splitScroll) + line) % 240
+			return mmc5.exRam[mmc5.splitY/8*32+mmc5.column&31]
+		}
+
+	case PpuFetchAttribute:
+		switch {
+		case mmc5.inSplit:
+			col := mmc5.column & 31
+			attr := mmc5.exRam[0x3c0+mmc5.splitY/32*8+col/4]
+			shift := uint(mmc5.splitY/16&1)<<2 | uint(col/2&1)<<1
+			return (attr >> shift & 3) * 0x55
+		case mmc5.exRamMode == 1:
+			// Extended attributes give each tile its own palette
+			return (mmc5.exRam[mmc5.tile] >> 6) * 0x55
+		}
+
+	case PpuFetchBackground:
+		switch {
+		case mmc5.inSplit:
+			addr = addr&^7 | uint16(mmc5.splitY&7)
+			return loadBanked(mmc5.chr(), int(mmc5.splitBank), 0x1000, addr)
+		case mmc5.exRamMode == 1:
+			// Extended attributes also pick a 4 KB bank for each tile
+			bank := int(mmc5.chrUpper)<<6 | int(mmc5.exRam[mmc5.tile]&0x3f)
+			return loadBanked(mmc5.chr(), bank, 0x1000, addr)
+		case mmc5.sprites8x16:
+			return loadBanked(mmc5.chr(), mmc5.chrBank(addr, true), 0x400, addr)
+		}
+
+	case PpuFetchSprite:
+		// The next nametable fetch is the first tile of the next scanline
+		mmc5.column = -1
+		if mmc5.sprites8x16 {
+			return loadBanked(mmc5.chr(), mmc5.chrBank(addr, false), 0x400, addr)
+		}
+	}
+	return val
+}
+
+// Returns whether a tile column shows the split region
+func (mmc5 *Mmc5) splitColumn(column int) bool {
+	if mmc5.splitCtrl&0x80 == 0 || mmc5.exRamMode >= 2 {
+		return false
+	}
+	threshold := int(mmc5.splitCtrl & 0x1f)
+	if mmc5.splitCtrl&0x40 == 0 {
+		return column < threshold
+	}
+	return column >= threshold
+}
+
+// Dots in 3 CPU cycles, longer than any gap between fetches while rendering
+const mmc5IdleDots = 9
+
+func (mmc5 *Mmc5) endFrame() {
+	mmc5.inFrame = false
+	mmc5.lastFetch = 0xffff // Fetches before and after don't repeat each other
+}
+
+func (mmc5 *Mmc5) countScanline() {
+	if !mmc5.inFrame {
+		mmc5.inFrame = true
+		mmc5.scanline = 0
+		return
+	}
+	mmc5.scanline++
+	if mmc5.scanline == mmc5.irqCompare {
+		mmc5.irqPending = true
+	}
+}
+
+func (mmc5 *Mmc5) Irq() bool { return mmc5.irqPending && mmc5.irqEnabled }
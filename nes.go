@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"github.com/0xe2-0x9a-0x9b/Go-SDL/sdl"
 	"github.com/0xe2-0x9a-0x9b/Go-SDL/sdl/audio"
+	"strings"
 	"unsafe"
 )
 
@@ -14,14 +15,28 @@ type Nes struct {
 	apu   *Apu
 	input *Input
 	mem   *MemoryMap
+
+	region   Region
+	timing   *RegionTiming
+	ppuCycle uint64 // CPU cycle the PPU has caught up to
+	ppuDots  int    // Fifths of a PPU dot owed from previous cycles
+	newFrame bool
+
+	// Optional mapper capabilities
+	clockedMapper      CpuClockedMapper
+	interruptingMapper InterruptingMapper
 }
 
 func NewNes(rom *Rom) *Nes {
-	mapper := NewMapper(rom)
+	nes := newNes(NewMapper(rom))
+	nes.ppu.vram.setFourScreen(rom.FourScreen())
+	return nes
+}
 
+func newNes(mapper Mapper) *Nes {
 	cpu := &Cpu{}
-	ppu := &Ppu{vram: &VramMemoryMap{mapper: mapper}}
-	apu := &Apu{}
+	ppu := &Ppu{vram: NewVramMemoryMap(mapper)}
+	apu := NewApu()
 	input := &Input{}
 	mem := &MemoryMap{
 		cpu:    cpu,
@@ -31,12 +46,83 @@ func NewNes(rom *Rom) *Nes {
 		mapper: mapper}
 
 	ppu.Setup()
+	apu.mem = mem
+	apu.expansion, _ = mapper.(AudioMapper)
+	mem.registerMapper, _ = mapper.(PpuRegisterMapper)
 
 	cpu.MemoryMap = mem
 	cpu.Power()
 	cpu.Reset()
 
-	return &Nes{cpu, ppu, apu, input, mem}
+	nes := &Nes{cpu: cpu, ppu: ppu, apu: apu, input: input, mem: mem, timing: RegionNtsc.Timing()}
+	nes.clockedMapper, _ = mapper.(CpuClockedMapper)
+	nes.interruptingMapper, _ = mapper.(InterruptingMapper)
+	mem.syncPpu = nes.syncPpu
+	return nes
+}
+
+// Switches the console to the timing of a region, before running. The APU
+// sample rate must be set again afterwards.
+func (nes *Nes) SetRegion(region Region) {
+	nes.region = region
+	nes.timing = region.Timing()
+	nes.ppu.timing = nes.timing
+	nes.apu.SetRegion(region)
+}
+
+func (nes *Nes) Timing() *RegionTiming { return nes.timing }
+
+// Runs one CPU instruction and the PPU and APU for the same time. Returns
+// whether the PPU completed a frame.
+func (nes *Nes) Step() bool {
+	nes.newFrame = false
+	cycles := nes.cpu.Step()
+	if nes.ppu.nmiCancelled {
+		nes.ppu.nmiCancelled = false
+		nes.cpu.CancelNmi()
+	}
+	nes.runPpu(nes.cpu.cycles, true)
+
+	nes.apu.Step(cycles)
+	nes.cpu.SetIrq(IrqApu, nes.apu.Irq())
+
+	if nes.clockedMapper != nil {
+		for i := 0; i < cycles; i++ {
+			nes.clockedMapper.ClockCpu()
+		}
+	}
+	if nes.interruptingMapper != nil {
+		nes.cpu.SetIrq(IrqMapper, nes.interruptingMapper.Irq())
+	}
+
+	return nes.newFrame
+}
+
+// Runs the PPU up to the cycle on which the CPU accesses a PPU register, so
+// the access sees the state of that exact cycle
+func (nes *Nes) syncPpu() {
+	nes.runPpu(nes.cpu.accessCycle(), false)
+}
+
+// Runs the PPU up to the start of a CPU cycle. An NMI raised on the cycle
+// before the end of an instruction is too late for the CPU to poll.
+func (nes *Nes) runPpu(cycle uint64, endOfInstruction bool) {
+	for ; nes.ppuCycle < cycle; nes.ppuCycle++ {
+		// PAL runs 3.2 PPU dots per CPU cycle
+		nes.ppuDots += nes.timing.ppuDots
+		for ; nes.ppuDots >= 5; nes.ppuDots -= 5 {
+			switch nes.ppu.Step() {
+			case PpuVblankNmi:
+				if endOfInstruction && nes.ppuCycle == cycle-1 {
+					nes.cpu.DelayedNmi()
+				} else {
+					nes.cpu.Nmi()
+				}
+			case PpuNewFrame:
+				nes.newFrame = true
+			}
+		}
+	}
 }
 
 var keyMap = map[uint32]int{
@@ -50,20 +136,42 @@ var keyMap = map[uint32]int{
 	sdl.K_RSHIFT: InputSelect,
 }
 
+// Keys that toggle muting of each APU channel
+var muteKeyMap = map[uint32]int{
+	sdl.K_F1: ChannelPulse1,
+	sdl.K_F2: ChannelPulse2,
+	sdl.K_F3: ChannelTriangle,
+	sdl.K_F4: ChannelNoise,
+	sdl.K_F5: ChannelDmc,
+	sdl.K_F6: ChannelExpansion,
+}
+
 const (
 	ScreenWidth  = 256
 	ScreenHeight = 240
 )
 
 var scale = 1
+var sampleRate = ApuSampleRate
+var muteChannels = ""
+var audioEnabled = true
+var recordAudio = ""
+var headless = false
+var maxFrames = 0
+var nsfSong = 0
+var paletteName = DefaultPalette
+var ntscFilter = false
+var regionName = ""
 
-func blit(pixels []Pixel, surface *sdl.Surface) {
+// Wider frames repeat rows to keep the aspect ratio
+func blit(pixels []Pixel, width int, surface *sdl.Surface) {
+	rowScale := scale * width / ScreenWidth
 	surface.Lock()
 	surfacePtr := uintptr(surface.Pixels)
 	for y := 0; y < ScreenHeight; y++ {
-		pixelIndex := y * ScreenWidth
-		for sy := 0; sy < scale; sy++ {
-			for x := 0; x < ScreenWidth; x++ {
+		pixelIndex := y * width
+		for sy := 0; sy < rowScale; sy++ {
+			for x := 0; x < width; x++ {
 				pixel := pixels[pixelIndex]
 				pixelIndex++
 				color := sdl.MapRGBA(surface.Format, pixel.R, pixel.G, pixel.B, 255)
@@ -72,7 +180,7 @@ func blit(pixels []Pixel, surface *sdl.Surface) {
 					surfacePtr += unsafe.Sizeof(color)
 				}
 			}
-			pixelIndex -= ScreenWidth
+			pixelIndex -= width
 		}
 	}
 	surface.Unlock()
@@ -80,77 +188,184 @@ func blit(pixels []Pixel, surface *sdl.Surface) {
 }
 
 func runAudio(ch chan []int16) {
-	for samples := <-ch; samples != nil; {
+	for samples := range ch {
 		audio.SendAudio_int16(samples)
 	}
 }
 
 func main() {
 	flag.IntVar(&scale, "scale", 1, "scaling factor to apply to the screen size")
+	flag.IntVar(&sampleRate, "sample-rate", ApuSampleRate, "audio output rate in Hz")
+	flag.BoolVar(&audioEnabled, "audio", true, "enable audio output; pacing falls back to a timer without it")
+	flag.StringVar(&muteChannels, "mute", "", "comma-separated APU channels to mute (pulse1,pulse2,triangle,noise,dmc,expansion)")
+	flag.StringVar(&recordAudio, "record-audio", "", "record audio output to a .wav file")
+	flag.BoolVar(&headless, "headless", false, "run without video, audio or input, as fast as possible")
+	flag.IntVar(&maxFrames, "frames", 0, "stop after this many frames (0 runs until quit)")
+	flag.IntVar(&nsfSong, "song", 0, "1-based song to play from an NSF (0 uses the default)")
+	flag.StringVar(&paletteName, "palette", DefaultPalette,
+		fmt.Sprintf("built-in palette (%v) or .pal file", strings.Join(PaletteNames(), ", ")))
+	flag.BoolVar(&ntscFilter, "ntsc", false, "simulate NTSC composite video, ignoring the palette")
+	flag.StringVar(&regionName, "region", "", "console timing (ntsc, pal or dendy); defaults to the ROM header")
 	flag.Parse()
 
 	if flag.NArg() != 1 {
-		fmt.Println("Usage: gomu [--scale=<factor>] /path/to/rom")
+		fmt.Println("Usage: gomu [--scale=<factor>] [--audio=<bool>] [--sample-rate=<hz>] [--mute=<channels>]")
+		fmt.Println("            [--record-audio=<file.wav>] [--headless] [--frames=<count>] [--song=<n>]")
+		fmt.Println("            [--palette=<name|file.pal>] [--ntsc] [--region=<ntsc|pal|dendy>]")
+		fmt.Println("            /path/to/rom.nes|/path/to/music.nsf")
 		return
 	}
 
-	rom, err := LoadRom(flag.Arg(0))
+	var region Region
+	if regionName != "" {
+		var err error
+		if region, err = ParseRegion(regionName); err != nil {
+			panic(fmt.Sprintf("Failed to set region: %v", err))
+		}
+	}
+
+	var nes *Nes
+	var player *NsfPlayer
+	var step func() bool
+	if strings.HasSuffix(strings.ToLower(flag.Arg(0)), ".nsf") {
+		// NSF files play through the CPU and APU alone; a frame is one play call
+		nsf, err := LoadNsf(flag.Arg(0))
+		if err != nil {
+			panic(fmt.Sprintf("Failed to load NSF: %v", err))
+		}
+		player = NewNsfPlayer(nsf)
+		if regionName != "" {
+			player.SetRegion(region)
+		}
+		if nsfSong > 0 {
+			player.PlaySong(nsfSong - 1)
+		}
+		nes = player.Nes
+		step = player.Step
+	} else {
+		rom, err := LoadRom(flag.Arg(0))
+		if err != nil {
+			panic(fmt.Sprintf("Failed to load ROM: %v", err))
+		}
+		nes = NewNes(rom)
+		if regionName == "" {
+			region = rom.Region()
+		}
+		nes.SetRegion(region)
+		step = nes.Step
+	}
+
+	palette, err := FindPalette(paletteName)
 	if err != nil {
-		panic(fmt.Sprintf("Failed to load ROM: %v", err))
+		panic(fmt.Sprintf("Failed to load palette: %v", err))
+	}
+	nes.ppu.Palette = palette
+	if ntscFilter {
+		nes.ppu.EnableNtscFilter()
+	}
+
+	nes.apu.SetSampleRate(sampleRate)
+	if muteChannels != "" {
+		for _, name := range strings.Split(muteChannels, ",") {
+			ch, err := ParseChannel(name)
+			if err != nil {
+				panic(fmt.Sprintf("Failed to mute channel: %v", err))
+			}
+			nes.apu.Mixer.SetMuted(ch, true)
+		}
+	}
+
+	if recordAudio != "" {
+		recorder, err := CreateWav(recordAudio, sampleRate)
+		if err != nil {
+			panic(fmt.Sprintf("Failed to record audio: %v", err))
+		}
+		nes.apu.Recorder = recorder
+		defer func() {
+			nes.apu.FlushRecording()
+			if err := recorder.Close(); err != nil {
+				fmt.Printf("Failed to write audio recording: %v\n", err)
+			}
+		}()
+	}
+
+	if headless {
+		for frames := 0; maxFrames == 0 || frames < maxFrames; {
+			if step() {
+				frames++
+			}
+		}
+		return
 	}
 
-	if sdl.Init(sdl.INIT_VIDEO|sdl.INIT_JOYSTICK|sdl.INIT_AUDIO) != 0 {
+	sdlFlags := uint32(sdl.INIT_VIDEO | sdl.INIT_JOYSTICK)
+	if audioEnabled {
+		sdlFlags |= sdl.INIT_AUDIO
+	}
+	if sdl.Init(sdlFlags) != 0 {
 		panic(fmt.Sprintf("SDL failed to initialize: %v", sdl.GetError()))
 	}
 	defer sdl.Quit()
 
-	screen := sdl.SetVideoMode(ScreenWidth*scale, ScreenHeight*scale, 32, sdl.SWSURFACE)
+	width := nes.ppu.FrameWidth()
+	screen := sdl.SetVideoMode(width*scale, ScreenHeight*scale*width/ScreenWidth, 32, sdl.SWSURFACE)
 	if screen == nil {
 		panic(fmt.Sprintf("SDL screen failed to initialize: %v", sdl.GetError()))
 	}
 	sdl.WM_SetCaption("Gomu", "")
 
-	audioSpec := &audio.AudioSpec{
-		Freq:     44100,
-		Format:   audio.AUDIO_S16SYS,
-		Channels: 1,
-		Samples:  4410,
+	frameRate := nes.Timing().FrameRate()
+	if player != nil {
+		frameRate = player.PlayRate()
 	}
-	if audio.OpenAudio(audioSpec, nil) != 0 {
-		panic(fmt.Sprintf("SDL audio failed to initialize: %v", sdl.GetError()))
-	}
-	defer audio.CloseAudio()
-	audio.PauseAudio(false)
+	var pacer Pacer = NewClockPacer(frameRate)
+	if audioEnabled {
+		audioSpec := &audio.AudioSpec{
+			Freq:     sampleRate,
+			Format:   audio.AUDIO_S16SYS,
+			Channels: 1,
+			Samples:  uint16(sampleRate / 10),
+		}
+		if audio.OpenAudio(audioSpec, nil) != 0 {
+			panic(fmt.Sprintf("SDL audio failed to initialize: %v", sdl.GetError()))
+		}
+		defer audio.CloseAudio()
+		audio.PauseAudio(false)
 
-	audioChan := make(chan []int16, 2)
-	go runAudio(audioChan)
+		audioChan := make(chan []int16, 8)
+		go runAudio(audioChan)
 
-	nes := NewNes(rom)
+		nes.apu.Output = audioChan
+		pacer = NewAudioPacer(nes.apu, audioChan, sampleRate)
+	}
 
+	frames := 0
 RUN:
-	for {
-		cycles := nes.cpu.Step()
-
-		for i := 0; i < cycles*3; i++ {
-			ppuResult := nes.ppu.Step()
-			switch ppuResult {
-			case PpuVblankNmi:
-				nes.cpu.Nmi()
-			case PpuNewFrame:
-				blit(nes.ppu.Framebuffer, screen)
-			}
+	for maxFrames == 0 || frames < maxFrames {
+		if step() {
+			blit(nes.ppu.Framebuffer, width, screen)
+			pacer.Wait()
+			frames++
 		}
 
-		nes.apu.Step(cycles)
-		// TODO forward audio to audioChan
-
 		// Pump events
 		event := sdl.Poll()
 		switch e := event.(type) {
 		case sdl.KeyboardEvent:
-			if in, ok := keyMap[e.Keysym.Sym]; ok {
+			if player != nil {
+				// Left and right select the song
+				if e.Type == sdl.KEYDOWN && e.Keysym.Sym == sdl.K_LEFT {
+					player.PlaySong((player.Song() + player.Songs() - 1) % player.Songs())
+				}
+				if e.Type == sdl.KEYDOWN && e.Keysym.Sym == sdl.K_RIGHT {
+					player.PlaySong((player.Song() + 1) % player.Songs())
+				}
+			} else if in, ok := keyMap[e.Keysym.Sym]; ok {
 				nes.input.SetState(0, in, e.Type == sdl.KEYDOWN)
 			}
+			if ch, ok := muteKeyMap[e.Keysym.Sym]; ok && e.Type == sdl.KEYDOWN {
+				nes.apu.Mixer.SetMuted(ch, !nes.apu.Mixer.Muted(ch))
+			}
 			if e.Keysym.Sym == sdl.K_ESCAPE {
 				break RUN
 			}
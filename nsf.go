@@ -0,0 +1,280 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"os"
+)
+
+type NsfHeader struct {
+	Magic         [5]byte
+	Version       byte
+	TotalSongs    byte
+	StartingSong  byte // 1-based
+	LoadAddr      uint16
+	InitAddr      uint16
+	PlayAddr      uint16
+	SongName      [32]byte
+	Artist        [32]byte
+	Copyright     [32]byte
+	NtscSpeed     uint16 // Microseconds between play calls
+	BankswitchReg [8]byte
+	PalSpeed      uint16
+	Region        byte
+	ExtraSound    byte
+	Reserved      [4]byte
+}
+
+type Nsf struct {
+	header NsfHeader
+	data   []byte
+}
+
+func LoadNsf(filename string) (*Nsf, error) {
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	header := &NsfHeader{}
+	err = binary.Read(file, binary.LittleEndian, header)
+	if err != nil {
+		return nil, err
+	}
+
+	if string(header.Magic[:]) != "NESM\x1a" {
+		return nil, errors.New("nsf header corrupted")
+	}
+	if header.TotalSongs == 0 {
+		return nil, errors.New("nsf has no songs")
+	}
+	if header.LoadAddr < 0x8000 {
+		return nil, errors.New("nsf load address below 0x8000 unsupported")
+	}
+
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, errors.New("failed to read nsf data")
+	}
+
+	return &Nsf{*header, data}, nil
+}
+
+func (nsf *Nsf) Region() Region {
+	// Bit 0 selects PAL, unless bit 1 marks the tune as playable on both
+	if nsf.header.Region&3 == 1 {
+		return RegionPal
+	}
+	return RegionNtsc
+}
+
+func (nsf *Nsf) Bankswitched() bool {
+	for _, bank := range nsf.header.BankswitchReg {
+		if bank != 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// Minimal driver placed in otherwise unused address space. Reset calls init and
+// spins in an idle loop; NMI calls play and returns to the loop.
+const (
+	NsfDriverInit = 0x4100
+	NsfDriverIdle = 0x4103
+	NsfDriverPlay = 0x4106
+	NsfDriverRti  = 0x4109
+)
+
+// Serves the NSF data, RAM, bank registers and driver to the CPU bus
+type NsfMapper struct {
+	nsf    *Nsf
+	prg    []uint8 // Data padded to whole 4 KB banks
+	banks  [8]int  // Offset into prg for each 4 KB slot at 0x8000-0xffff
+	prgRam []uint8 // 8 KB RAM
+	driver [0x10]uint8
+}
+
+func NewNsfMapper(nsf *Nsf) *NsfMapper {
+	mapper := &NsfMapper{nsf: nsf, prgRam: make([]uint8, 8192)}
+
+	// Without bankswitching, data loads at its address within 0x8000-0xffff;
+	// with it, only the offset within the first bank matters
+	padding := int(nsf.header.LoadAddr) & 0xfff
+	if !nsf.Bankswitched() {
+		padding = int(nsf.header.LoadAddr) - 0x8000
+	}
+	size := (padding + len(nsf.data) + 0xfff) &^ 0xfff
+	if size < 0x8000 {
+		size = 0x8000
+	}
+	mapper.prg = make([]uint8, size)
+	copy(mapper.prg[padding:], nsf.data)
+
+	init, play := nsf.header.InitAddr, nsf.header.PlayAddr
+	mapper.driver = [0x10]uint8{
+		0x20, uint8(init), uint8(init >> 8), // JSR init
+		0x4c, NsfDriverIdle & 0xff, NsfDriverIdle >> 8, // JMP idle
+		0x20, uint8(play), uint8(play >> 8), // JSR play
+		0x40, // RTI
+	}
+
+	mapper.resetBanks()
+	return mapper
+}
+
+func (mapper *NsfMapper) resetBanks() {
+	for slot := range mapper.banks {
+		bank := slot
+		if mapper.nsf.Bankswitched() {
+			bank = int(mapper.nsf.header.BankswitchReg[slot])
+		}
+		mapper.setBank(slot, bank)
+	}
+}
+
+func (mapper *NsfMapper) setBank(slot int, bank int) {
+	mapper.banks[slot] = (bank * 0x1000) % len(mapper.prg)
+}
+
+func (mapper *NsfMapper) LoadPrg(addr uint16) uint8 {
+	switch {
+	case addr >= NsfDriverInit && addr < NsfDriverInit+uint16(len(mapper.driver)):
+		return mapper.driver[addr-NsfDriverInit]
+	case addr < 0x6000:
+		return 0
+	case addr < 0x8000:
+		return mapper.prgRam[addr-0x6000]
+	case addr >= NmiVector:
+		// Route the vectors to the driver
+		vectors := [6]uint8{
+			NsfDriverPlay & 0xff, NsfDriverPlay >> 8,
+			NsfDriverInit & 0xff, NsfDriverInit >> 8,
+			NsfDriverRti & 0xff, NsfDriverRti >> 8,
+		}
+		return vectors[addr-NmiVector]
+	}
+	slot := (addr - 0x8000) >> 12
+	return mapper.prg[mapper.banks[slot]+int(addr&0xfff)]
+}
+
+func (mapper *NsfMapper) StorePrg(addr uint16, val uint8) {
+	switch {
+	case addr >= 0x5ff8 && addr < 0x6000:
+		if mapper.nsf.Bankswitched() {
+			mapper.setBank(int(addr-0x5ff8), int(val))
+		}
+	case addr >= 0x6000 && addr < 0x8000:
+		mapper.prgRam[addr-0x6000] = val
+	}
+}
+
+func (mapper *NsfMapper) LoadChr(addr uint16) uint8       { return 0 }
+func (mapper *NsfMapper) StoreChr(addr uint16, val uint8) {}
+func (mapper *NsfMapper) Mirroring() Mirroring            { return MirrorHorizontal }
+
+// Plays NSF songs on the CPU and APU alone, calling the play routine at the rate
+// given in the header instead of on PPU vblank
+type NsfPlayer struct {
+	*Nes
+	nsf        *Nsf
+	mapper     *NsfMapper
+	song       int // 0-based
+	playPeriod int // CPU cycles between play calls
+	playTimer  int
+}
+
+func NewNsfPlayer(nsf *Nsf) *NsfPlayer {
+	mapper := NewNsfMapper(nsf)
+	player := &NsfPlayer{
+		Nes:    newNes(mapper),
+		nsf:    nsf,
+		mapper: mapper,
+		song:   int(nsf.header.StartingSong) - 1,
+	}
+	player.mem.syncPpu = nil // The PPU doesn't run
+	player.SetRegion(nsf.Region())
+	return player
+}
+
+// Switches to the timing of a region and restarts the current song
+func (player *NsfPlayer) SetRegion(region Region) {
+	player.Nes.SetRegion(region)
+
+	speed := int(player.nsf.header.NtscSpeed)
+	if region != RegionNtsc {
+		speed = int(player.nsf.header.PalSpeed)
+	}
+	if speed == 0 {
+		speed = int(1000000 / player.timing.frameRate)
+	}
+	player.playPeriod = int(int64(speed) * int64(player.timing.cpuFrequency) / 1000000)
+	player.PlaySong(player.song)
+}
+
+// Returns the play calls per second
+func (player *NsfPlayer) PlayRate() float64 {
+	return float64(player.timing.cpuFrequency) / float64(player.playPeriod)
+}
+
+func (player *NsfPlayer) Songs() int { return int(player.nsf.header.TotalSongs) }
+func (player *NsfPlayer) Song() int  { return player.song }
+
+// Resets the machine and runs the init routine for the given 0-based song
+func (player *NsfPlayer) PlaySong(song int) {
+	if song < 0 || song >= player.Songs() {
+		song = 0
+	}
+	player.song = song
+
+	for i := range player.mem.ram {
+		player.mem.ram[i] = 0
+	}
+	for i := range player.mapper.prgRam {
+		player.mapper.prgRam[i] = 0
+	}
+	player.mapper.resetBanks()
+
+	for addr := uint16(0x4000); addr <= 0x4013; addr++ {
+		player.apu.Store(addr, 0)
+	}
+	player.apu.Store(0x4015, 0)
+	player.apu.Store(0x4015, 0x0f)
+	player.apu.Store(0x4017, 0x40)
+
+	cpu := player.cpu
+	cpu.idleCycles = 0
+	cpu.nmiPending = false
+	cpu.Power()
+	cpu.a = uint8(song)
+	cpu.x = 0 // NTSC
+	if player.region != RegionNtsc {
+		cpu.x = 1 // PAL
+	}
+	cpu.pc = NsfDriverInit
+
+	player.playTimer = player.playPeriod
+}
+
+// Runs one CPU instruction and the APU for the same time. Returns whether the
+// play routine was called.
+func (player *NsfPlayer) Step() bool {
+	cycles := player.cpu.Step()
+	player.apu.Step(cycles)
+	player.cpu.SetIrq(IrqApu, player.apu.Irq())
+
+	// Wait for init or the last play call to return before calling play again
+	player.playTimer -= cycles
+	if player.playTimer <= 0 && player.cpu.pc == NsfDriverIdle {
+		player.playTimer += player.playPeriod
+		if player.playTimer <= 0 {
+			// Drop the calls missed while play overran
+			player.playTimer = player.playPeriod
+		}
+		player.cpu.Nmi()
+		return true
+	}
+	return false
+}
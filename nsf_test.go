@@ -0,0 +1,88 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Writes an NSF whose init stores the song number at 0x00 and whose play
+// increments 0x01
+func writeTestNsf(t *testing.T) string {
+	header := NsfHeader{
+		Magic:        [5]byte{'N', 'E', 'S', 'M', 0x1a},
+		Version:      1,
+		TotalSongs:   3,
+		StartingSong: 2,
+		LoadAddr:     0x8000,
+		InitAddr:     0x8000,
+		PlayAddr:     0x8003,
+		NtscSpeed:    16639,
+	}
+	code := []uint8{
+		0x85, 0x00, // STA $00
+		0x60,       // RTS
+		0xe6, 0x01, // INC $01
+		0x60, // RTS
+	}
+
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.LittleEndian, &header)
+	buf.Write(code)
+
+	filename := filepath.Join(t.TempDir(), "test.nsf")
+	if err := os.WriteFile(filename, buf.Bytes(), 0644); err != nil {
+		t.Fatalf("Failed to write NSF: %v", err)
+	}
+	return filename
+}
+
+func TestNsfPlayer(t *testing.T) {
+	nsf, err := LoadNsf(writeTestNsf(t))
+	if err != nil {
+		t.Fatalf("Failed to load NSF: %v", err)
+	}
+
+	player := NewNsfPlayer(nsf)
+	plays := 0
+	for plays < 10 {
+		if player.Step() {
+			plays++
+		}
+	}
+	// Let the last play call run
+	for player.cpu.pc != NsfDriverIdle || player.cpu.nmiPending {
+		player.Step()
+	}
+
+	ram := &player.mem.ram
+	if ram[0] != 1 {
+		t.Errorf("Init received song %v, expected 1 (second song)", ram[0])
+	}
+	if ram[1] != 10 {
+		t.Errorf("Play called %v times, expected 10", ram[1])
+	}
+
+	player.PlaySong(2)
+	for !player.Step() {
+	}
+	if ram[0] != 2 || ram[1] != 0 {
+		t.Errorf("Song 2 init state %v, %v; expected 2, 0", ram[0], ram[1])
+	}
+}
+
+func TestNsfPlayRate(t *testing.T) {
+	nsf, err := LoadNsf(writeTestNsf(t))
+	if err != nil {
+		t.Fatalf("Failed to load NSF: %v", err)
+	}
+
+	nsf.header.NtscSpeed = 4000
+	player := NewNsfPlayer(nsf)
+	if rate := player.PlayRate(); math.Abs(rate-250) > 0.1 {
+		t.Errorf("Play rate %v, expected 250", rate)
+	}
+}
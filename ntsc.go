@@ -0,0 +1,72 @@
+package main
+
+import "math"
+
+// Width of frames from the NTSC filter, two output pixels per PPU pixel
+const NtscWidth = ScreenWidth * 2
+
+// The PPU generates 8 samples of the composite signal per pixel, and the color
+// subcarrier has a period of 12 samples
+const (
+	ntscSamplesPerPixel = 8
+	ntscPhases          = 12
+	ntscPadding         = ntscPhases / 2 // Black samples around each scanline
+)
+
+// Simulates the composite video signal of the NTSC PPU and a TV decoding it.
+// Colors bleed into their neighbors and fine patterns turn into color
+// artifacts, which crawl as the subcarrier phase shifts from frame to frame.
+type NtscFilter struct {
+	levels [8 * 64][ntscPhases]float32 // Signal for each color at each phase
+	cos    [ntscPhases]float32         // Decoder carrier for each phase
+	sin    [ntscPhases]float32
+	signal []float32 // One scanline of samples
+}
+
+func NewNtscFilter() *NtscFilter {
+	filter := &NtscFilter{
+		signal: make([]float32, ScreenWidth*ntscSamplesPerPixel+2*ntscPadding),
+	}
+	for index := range filter.levels {
+		for phase := 0; phase < ntscPhases; phase++ {
+			filter.levels[index][phase] = float32(ntscSignal(uint8(index&0x3f), uint8(index>>6), phase))
+		}
+	}
+	for phase := 0; phase < ntscPhases; phase++ {
+		angle := math.Pi / 6 * float64(phase+ntscHue)
+		filter.cos[phase] = float32(math.Cos(angle))
+		filter.sin[phase] = float32(math.Sin(angle))
+	}
+	return filter
+}
+
+// Converts a frame of PPU pixels to NtscWidth RGB pixels per scanline, given
+// the subcarrier phase at the start of the first scanline
+func (filter *NtscFilter) Apply(pixels []PpuPixel, out []Pixel, framePhase int) {
+	for y := 0; y < ScreenHeight; y++ {
+		// Each scanline is 341 * 8 samples long, shifting the phase by 4
+		phase := (framePhase + y*4) % ntscPhases
+
+		signal := filter.signal[ntscPadding:]
+		for x, pixel := range pixels[y*ScreenWidth : (y+1)*ScreenWidth] {
+			levels := &filter.levels[uint(pixel.emphasis&7)<<6|uint(pixel.color&0x3f)]
+			for s := 0; s < ntscSamplesPerPixel; s++ {
+				sample := x*ntscSamplesPerPixel + s
+				signal[sample] = levels[(phase+sample)%ntscPhases]
+			}
+		}
+
+		// Decode a full subcarrier cycle around every fourth sample
+		for x := 0; x < NtscWidth; x++ {
+			start := x*ntscSamplesPerPixel/2 + 2 // Centered on the output pixel, after padding
+			var luma, i, q float32
+			for n, v := range filter.signal[start : start+ntscPhases] {
+				p := (phase + start - ntscPadding + n + ntscPhases) % ntscPhases
+				luma += v
+				i += v * filter.cos[p]
+				q += v * filter.sin[p]
+			}
+			out[y*NtscWidth+x] = yiqToPixel(float64(luma/ntscPhases), float64(i/ntscPhases), float64(q/ntscPhases))
+		}
+	}
+}
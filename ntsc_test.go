@@ -0,0 +1,23 @@
+package main
+
+import "testing"
+
+func TestNtscFilterFlatColor(t *testing.T) {
+	filter := NewNtscFilter()
+	pixels := make([]PpuPixel, ScreenWidth*ScreenHeight)
+	for i := range pixels {
+		pixels[i] = PpuPixel{color: 0x16, emphasis: 1}
+	}
+	out := make([]Pixel, NtscWidth*ScreenHeight)
+	filter.Apply(pixels, out, 0)
+
+	// Away from the edges, a flat area decodes to the generated NTSC palette color
+	expected := builtinPalettes["ntsc"].Color(PpuPixel{color: 0x16, emphasis: 1})
+	near := func(a, b uint8) bool { return a+1 >= b && b+1 >= a }
+	for _, y := range []int{0, 1, 2, 100} {
+		got := out[y*NtscWidth+NtscWidth/2]
+		if !near(got.R, expected.R) || !near(got.G, expected.G) || !near(got.B, expected.B) {
+			t.Errorf("Scanline %d color %v, expected %v", y, got, expected)
+		}
+	}
+}
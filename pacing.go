@@ -0,0 +1,60 @@
+package main
+
+import "time"
+
+// Throttles emulation to real time. Wait is called once per emulated frame.
+type Pacer interface {
+	Wait()
+}
+
+// Paces frames against the wall clock, for running without audio
+type ClockPacer struct {
+	frameDuration time.Duration
+	next          time.Time
+}
+
+func NewClockPacer(frameRate float64) *ClockPacer {
+	return &ClockPacer{frameDuration: time.Duration(float64(time.Second) / frameRate)}
+}
+
+func (pacer *ClockPacer) Wait() {
+	now := time.Now()
+	// Resynchronize rather than racing to catch up after a stall
+	if pacer.next.IsZero() || now.Sub(pacer.next) > 4*pacer.frameDuration {
+		pacer.next = now
+	}
+	pacer.next = pacer.next.Add(pacer.frameDuration)
+	if wait := pacer.next.Sub(now); wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// Paces frames against the audio device. Emulation waits while the queue of
+// sample buffers is above half full, and the APU output rate is nudged up or
+// down by a fraction of a percent to hold the queue there. The pitch change is
+// inaudible, but the queue never drains (crackling) or overflows (dropping).
+type AudioPacer struct {
+	apu        *Apu
+	queue      chan []int16
+	sampleRate float64
+}
+
+const (
+	AudioPacerMaxRateDelta = 0.005
+	AudioPacerPollInterval = time.Millisecond
+)
+
+func NewAudioPacer(apu *Apu, queue chan []int16, sampleRate int) *AudioPacer {
+	return &AudioPacer{apu: apu, queue: queue, sampleRate: float64(sampleRate)}
+}
+
+func (pacer *AudioPacer) Wait() {
+	target := cap(pacer.queue) / 2
+	for len(pacer.queue) > target {
+		time.Sleep(AudioPacerPollInterval)
+	}
+
+	// Fill in [-1, 1] relative to the target
+	fill := float64(len(pacer.queue)-target) / float64(target)
+	pacer.apu.resampler.SetSampleRate(pacer.sampleRate * (1 - AudioPacerMaxRateDelta*fill))
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"os"
+	"sort"
+)
+
+// Output colors for each combination of the 3 emphasis bits and 64 palette
+// indexes
+type Palette [8 * 64]Pixel
+
+func (palette *Palette) Color(pixel PpuPixel) Pixel {
+	return palette[uint(pixel.emphasis&7)<<6|uint(pixel.color&0x3f)]
+}
+
+// Emphasizing a channel attenuates the other two, and emphasizing several
+// channels stacks
+const emphasisAttenuation = 0.816
+
+// Builds a palette from 64 0xRRGGBB colors, approximating emphasis
+func NewPalette(colors []uint32) *Palette {
+	palette := &Palette{}
+	for emphasis := 0; emphasis < 8; emphasis++ {
+		for i, rgb := range colors {
+			r := float64((rgb >> 16) & 0xff)
+			g := float64((rgb >> 8) & 0xff)
+			b := float64(rgb & 0xff)
+			// The blacks in columns 0xe and 0xf are unaffected
+			if i&0xe != 0xe {
+				if emphasis&1 != 0 { // Red
+					g *= emphasisAttenuation
+					b *= emphasisAttenuation
+				}
+				if emphasis&2 != 0 { // Green
+					r *= emphasisAttenuation
+					b *= emphasisAttenuation
+				}
+				if emphasis&4 != 0 { // Blue
+					r *= emphasisAttenuation
+					g *= emphasisAttenuation
+				}
+			}
+			palette[emphasis<<6|i] = Pixel{uint8(r), uint8(g), uint8(b)}
+		}
+	}
+	return palette
+}
+
+// Loads a .pal file of RGB triples: 64 colors, or 512 colors covering every
+// combination of the emphasis bits
+func LoadPalette(filename string) (*Palette, error) {
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	switch len(data) {
+	case 64 * 3:
+		colors := make([]uint32, 64)
+		for i := range colors {
+			colors[i] = uint32(data[i*3])<<16 | uint32(data[i*3+1])<<8 | uint32(data[i*3+2])
+		}
+		return NewPalette(colors), nil
+	case 512 * 3:
+		palette := &Palette{}
+		for i := range palette {
+			palette[i] = Pixel{data[i*3], data[i*3+1], data[i*3+2]}
+		}
+		return palette, nil
+	}
+	return nil, fmt.Errorf("palette has %d bytes, want 192 or 1536", len(data))
+}
+
+const DefaultPalette = "default"
+
+var builtinPalettes = map[string]*Palette{
+	DefaultPalette: NewPalette(defaultPaletteRgb),
+	"2c03":         NewPalette(rgbPpuPaletteRgb),
+	"ntsc":         NewNtscPalette(),
+}
+
+// Returns the built-in palette with the given name, or else loads the named
+// .pal file
+func FindPalette(name string) (*Palette, error) {
+	if palette, ok := builtinPalettes[name]; ok {
+		return palette, nil
+	}
+	return LoadPalette(name)
+}
+
+func PaletteNames() []string {
+	names := make([]string, 0, len(builtinPalettes))
+	for name := range builtinPalettes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+var defaultPaletteRgb = []uint32{
+	0x666666, 0x002a88, 0x1412a7, 0x3b00a4, 0x5c007e,
+	0x6e0040, 0x6c0600, 0x561d00, 0x333500, 0x0b4800,
+	0x005200, 0x004f08, 0x00404d, 0x000000, 0x000000,
+	0x000000, 0xadadad, 0x155fd9, 0x4240ff, 0x7527fe,
+	0xa01acc, 0xb71e7b, 0xb53120, 0x994e00, 0x6b6d00,
+	0x388700, 0x0c9300, 0x008f32, 0x007c8d, 0x000000,
+	0x000000, 0x000000, 0xfffeff, 0x64b0ff, 0x9290ff,
+	0xc676ff, 0xf36aff, 0xfe6ecc, 0xfe8170, 0xea9e22,
+	0xbcbe00, 0x88d800, 0x5ce430, 0x45e082, 0x48cdde,
+	0x4f4f4f, 0x000000, 0x000000, 0xfffeff, 0xc0dfff,
+	0xd3d2ff, 0xe8c8ff, 0xfbc2ff, 0xfec4ea, 0xfeccc5,
+	0xf7d8a5, 0xe4e594, 0xcfef96, 0xbdf4ab, 0xb3f3cc,
+	0xb5ebf2, 0xb8b8b8, 0x000000, 0x000000,
+}
+
+// The RGB PPU (2C03) used in arcade machines, with 3 bits per channel
+var rgbPpuPaletteRgb = makeRgbPpuPalette([]uint16{
+	0333, 0014, 0006, 0326, 0403, 0503, 0510, 0420, 0320, 0120, 0031, 0040, 0022, 0000, 0000, 0000,
+	0555, 0036, 0027, 0407, 0507, 0704, 0700, 0630, 0430, 0140, 0040, 0053, 0044, 0000, 0000, 0000,
+	0777, 0357, 0447, 0637, 0707, 0737, 0740, 0750, 0660, 0360, 0070, 0276, 0077, 0000, 0000, 0000,
+	0777, 0567, 0657, 0757, 0747, 0755, 0764, 0772, 0773, 0572, 0473, 0276, 0467, 0000, 0000, 0000,
+})
+
+func makeRgbPpuPalette(octal []uint16) []uint32 {
+	colors := make([]uint32, len(octal))
+	for i, rgb := range octal {
+		r := uint32(rgb>>6&7) * 255 / 7
+		g := uint32(rgb>>3&7) * 255 / 7
+		b := uint32(rgb&7) * 255 / 7
+		colors[i] = r<<16 | g<<8 | b
+	}
+	return colors
+}
+
+// Composite signal levels in volts for the 4 brightness levels of the PPU. Each
+// pixel is a square wave between the low and high level, in one of 12 phases of
+// the color subcarrier.
+var ntscLevelLow = [4]float64{0.350, 0.518, 0.962, 1.550}
+var ntscLevelHigh = [4]float64{1.094, 1.506, 1.962, 1.962}
+
+const (
+	ntscBlack               = 0.518
+	ntscWhite               = 1.962
+	ntscEmphasisAttenuation = 0.746
+	ntscHue                 = 4 // Phase offset of the decoder, in twelfths of a cycle
+)
+
+// Returns the signal level of a pixel at a phase (0-11) of the subcarrier,
+// where 0 is black and 1 is white
+func ntscSignal(color, emphasis uint8, phase int) float64 {
+	hue := int(color & 0xf)
+	level := (color >> 4) & 3
+	if hue > 0xd {
+		level = 1 // Black
+	}
+	low, high := ntscLevelLow[level], ntscLevelHigh[level]
+	if hue == 0 {
+		low = high
+	}
+	if hue > 0xc {
+		high = low
+	}
+
+	inPhase := func(hue int) bool { return (hue+phase)%12 < 6 }
+	signal := low
+	if inPhase(hue) {
+		signal = high
+	}
+	// Each emphasis bit attenuates the signal for a third of the cycle
+	if (emphasis&1 == 1 && inPhase(0)) || (emphasis&2 == 2 && inPhase(4)) || (emphasis&4 == 4 && inPhase(8)) {
+		signal *= ntscEmphasisAttenuation
+	}
+	return (signal - ntscBlack) / (ntscWhite - ntscBlack)
+}
+
+// Converts YIQ to a clamped RGB pixel
+func yiqToPixel(y, i, q float64) Pixel {
+	clamp := func(v float64) uint8 {
+		return uint8(math.Max(0, math.Min(255, v*255)))
+	}
+	return Pixel{
+		clamp(y + 0.946882*i + 0.623557*q),
+		clamp(y - 0.274788*i - 0.635691*q),
+		clamp(y - 1.108545*i + 1.709007*q),
+	}
+}
+
+// Generates a palette by decoding a whole subcarrier cycle of each color
+func NewNtscPalette() *Palette {
+	palette := &Palette{}
+	for index := range palette {
+		var y, i, q float64
+		for phase := 0; phase < 12; phase++ {
+			v := ntscSignal(uint8(index&0x3f), uint8(index>>6), phase) / 12
+			angle := math.Pi / 6 * float64(phase+ntscHue)
+			y += v
+			i += v * math.Cos(angle)
+			q += v * math.Sin(angle)
+		}
+		palette[index] = yiqToPixel(y, i, q)
+	}
+	return palette
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadPalette(t *testing.T) {
+	dir := t.TempDir()
+
+	// 64 colors, with emphasis approximated
+	data := make([]byte, 64*3)
+	data[0x16*3] = 200
+	copy(data[0x10*3:], []byte{200, 200, 200})
+	copy(data[0x1e*3:], []byte{50, 50, 50})
+	filename := filepath.Join(dir, "small.pal")
+	if err := os.WriteFile(filename, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	palette, err := LoadPalette(filename)
+	if err != nil {
+		t.Fatalf("Failed to load palette: %v", err)
+	}
+	if got := palette.Color(PpuPixel{color: 0x16}); got.R != 200 {
+		t.Errorf("Color 0x16 red %v, expected 200", got.R)
+	}
+	if got := palette.Color(PpuPixel{color: 0x16, emphasis: 2}); got.R != 163 {
+		t.Errorf("Green-emphasized color 0x16 red %v, expected 163", got.R)
+	}
+	if got := palette.Color(PpuPixel{color: 0x10, emphasis: 7}); got != (Pixel{133, 133, 133}) {
+		t.Errorf("Fully emphasized color 0x10 %v, expected all channels 133", got)
+	}
+	if got := palette.Color(PpuPixel{color: 0x10, emphasis: 3}); got.B >= got.R || got.B >= got.G {
+		t.Errorf("Red and green emphasized color 0x10 %v, expected blue dimmest", got)
+	}
+	if got := palette.Color(PpuPixel{color: 0x1e, emphasis: 7}); got != (Pixel{50, 50, 50}) {
+		t.Errorf("Fully emphasized color 0x1e %v, expected unchanged", got)
+	}
+
+	// 512 colors covering emphasis
+	data = make([]byte, 512*3)
+	data[(2<<6|0x16)*3+1] = 100
+	filename = filepath.Join(dir, "full.pal")
+	if err := os.WriteFile(filename, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	palette, err = LoadPalette(filename)
+	if err != nil {
+		t.Fatalf("Failed to load palette: %v", err)
+	}
+	if got := palette.Color(PpuPixel{color: 0x16, emphasis: 2}); got.G != 100 {
+		t.Errorf("Green-emphasized color 0x16 green %v, expected 100", got.G)
+	}
+
+	filename = filepath.Join(dir, "bad.pal")
+	if err := os.WriteFile(filename, make([]byte, 100), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := LoadPalette(filename); err == nil {
+		t.Error("Loaded palette with bad size")
+	}
+}
+
+func TestNtscPaletteHues(t *testing.T) {
+	palette, err := FindPalette("ntsc")
+	if err != nil {
+		t.Fatalf("Failed to find palette: %v", err)
+	}
+	if c := palette.Color(PpuPixel{color: 0x16}); c.R <= c.G || c.R <= c.B {
+		t.Errorf("Color 0x16 %v, expected red", c)
+	}
+	if c := palette.Color(PpuPixel{color: 0x1a}); c.G <= c.R || c.G <= c.B {
+		t.Errorf("Color 0x1a %v, expected green", c)
+	}
+	if c := palette.Color(PpuPixel{color: 0x12}); c.B <= c.R || c.B <= c.G {
+		t.Errorf("Color 0x12 %v, expected blue", c)
+	}
+	if c := palette.Color(PpuPixel{color: 0x0f}); c != (Pixel{}) {
+		t.Errorf("Color 0x0f %v, expected black", c)
+	}
+}
@@ -13,17 +13,64 @@ type Ppu struct {
 	writeLatch bool  // For PPUSCROLL and PPUADDR
 	readBuffer uint8 // For PPUDATA
 
+	// The I/O latch between the CPU and PPU holds the last value written or
+	// read, and each bit fades to 0 when not refreshed
+	ioLatch          uint8
+	ioLatchRefreshed [8]uint64 // Dot count when each bit was last driven
+
 	pbuffer     []PpuPixel // Internal framebuffer state
 	Framebuffer []Pixel    // External framebuffer state
+	Palette     *Palette   // Converts pbuffer to Framebuffer
+	ntsc        *NtscFilter
 
-	vram *VramMemoryMap
-	oam  [0x100]uint8
+	vram            *VramMemoryMap
+	busMapper       PpuBusMapper    // Optional
+	renderingMapper RenderingMapper // Optional
+	oam             [0x100]uint8
 
 	fineScrollX uint8
 
+	// Background fetch pipeline
+	nametableByte    uint8
+	attributeBits    uint8 // Palette number of the fetched tile
+	patternLow       uint8
+	patternHigh      uint8
+	patternShiftLow  uint16 // Two tiles of pattern data, the current one on top
+	patternShiftHigh uint16
+	attrShiftLow     uint16 // Palette number bits expanded to match the pattern data
+	attrShiftHigh    uint16
+
+	// Sprite evaluation for the next scanline
+	secondaryOam [0x20]uint8
+	oamLatch     uint8 // Byte read from OAM on the previous dot
+	evalSprite   int   // Sprite being evaluated
+	evalByte     int   // Byte of the sprite being copied
+	evalCount    int   // Sprites copied to secondary OAM
+	evalDone     bool
+	evalSprite0  bool // Sprite 0 is in secondary OAM
+
+	// Sprites fetched for the current scanline
+	spriteCount int
+	spriteZero  bool // Slot 0 holds sprite 0
+	spriteLow   [8]uint8
+	spriteHigh  [8]uint8
+	spriteAttr  [8]uint8
+	spriteX     [8]uint8
+
 	cycle    int // Cycle in the current scanline
 	scanline int // Scanline in the current frame
 	frame    int // Frame count
+
+	dots       uint64 // Dots since power on
+	framePhase int    // Color subcarrier phase at the start of the frame
+
+	// NMI output, the vblank flag gated by PPUCTRL bit 7
+	nmiLine        bool
+	nmiPending     bool // Rising edge not yet reported by Step
+	nmiCancelled   bool // An NMI just raised was suppressed by a register access
+	suppressVblank bool // Vblank flag suppressed by reading PPUSTATUS just before
+
+	timing *RegionTiming
 }
 
 type PpuCtrlReg uint8
@@ -31,35 +78,21 @@ type PpuMaskReg uint8
 type PpuStatusReg uint8
 
 type PpuPixel struct {
-	color uint8 // Index into palette
-	index int   // Priority
+	color    uint8 // Index into palette
+	emphasis uint8 // Red, green and blue emphasis bits
 }
 
 type Pixel struct {
 	R, G, B uint8
 }
 
+// Vblank starts and the frame ends on scanlines that depend on the region
 const PpuPrerenderScanline = -1
 const PpuQuietScanline = 240
-const PpuVblankStartScanline = 241
-const PpuVblankEndScanline = 260
 const PpuCyclesPerScanline = 341
 
-var paletteRgb = []uint32{
-	0x666666, 0x002a88, 0x1412a7, 0x3b00a4, 0x5c007e,
-	0x6e0040, 0x6c0600, 0x561d00, 0x333500, 0x0b4800,
-	0x005200, 0x004f08, 0x00404d, 0x000000, 0x000000,
-	0x000000, 0xadadad, 0x155fd9, 0x4240ff, 0x7527fe,
-	0xa01acc, 0xb71e7b, 0xb53120, 0x994e00, 0x6b6d00,
-	0x388700, 0x0c9300, 0x008f32, 0x007c8d, 0x000000,
-	0x000000, 0x000000, 0xfffeff, 0x64b0ff, 0x9290ff,
-	0xc676ff, 0xf36aff, 0xfe6ecc, 0xfe8170, 0xea9e22,
-	0xbcbe00, 0x88d800, 0x5ce430, 0x45e082, 0x48cdde,
-	0x4f4f4f, 0x000000, 0x000000, 0xfffeff, 0xc0dfff,
-	0xd3d2ff, 0xe8c8ff, 0xfbc2ff, 0xfec4ea, 0xfeccc5,
-	0xf7d8a5, 0xe4e594, 0xcfef96, 0xbdf4ab, 0xb3f3cc,
-	0xb5ebf2, 0xb8b8b8, 0x000000, 0x000000,
-}
+// I/O latch bits decay after about 600 ms
+const ppuOpenBusDecayDots = 3200000
 
 type PpuResult int
 
@@ -72,7 +105,30 @@ const (
 func (ppu *Ppu) Setup() {
 	ppu.pbuffer = make([]PpuPixel, 0xf000)
 	ppu.Framebuffer = make([]Pixel, 0xf000)
+	ppu.Palette = builtinPalettes[DefaultPalette]
+	ppu.timing = RegionNtsc.Timing()
 	ppu.scanline = 241
+	ppu.busMapper, _ = ppu.vram.mapper.(PpuBusMapper)
+	ppu.renderingMapper, _ = ppu.vram.mapper.(RenderingMapper)
+}
+
+// Makes a rendering fetch, showing pattern table addresses to a mapper watching
+// the bus and letting a mapper that takes part in rendering replace the value
+func (ppu *Ppu) fetch(kind PpuFetch, addr uint16) uint8 {
+	val := ppu.vram.Load(addr)
+	if addr < 0x2000 {
+		ppu.watchAddress(addr)
+	}
+	if ppu.renderingMapper != nil {
+		val = ppu.renderingMapper.RenderFetch(kind, addr, val, ppu.dots)
+	}
+	return val
+}
+
+func (ppu *Ppu) watchAddress(addr uint16) {
+	if ppu.busMapper != nil {
+		ppu.busMapper.PpuAddress(addr, ppu.dots)
+	}
 }
 
 func (ppu *Ppu) Step() PpuResult {
@@ -83,298 +139,483 @@ func (ppu *Ppu) Step() PpuResult {
 		ppu.prerenderScanlineCycle()
 	case ppu.scanline < PpuQuietScanline:
 		ppu.renderScanlineCycle()
-	case ppu.scanline == PpuQuietScanline:
-		// PPU is idle for one scanline before vblank starts
-	case ppu.scanline >= PpuVblankStartScanline:
-		nmi := ppu.vblankScanlineCycle()
-		if nmi {
-			ret = PpuVblankNmi
-		}
+	case ppu.scanline < ppu.timing.vblankStartScanline:
+		// PPU is idle for at least one scanline before vblank starts
+	default:
+		ppu.vblankScanlineCycle()
 	}
 
+	ppu.dots++
+	ppu.cycle++
+	// With rendering enabled, NTSC skips the last dot of the pre-render
+	// scanline on odd frames
+	if ppu.scanline == PpuPrerenderScanline && ppu.cycle == PpuCyclesPerScanline-1 &&
+		ppu.frame&1 == 1 && ppu.timing.skipOddDot && ppu.renderingEnabled() {
+		ppu.cycle++
+	}
 	if ppu.cycle == PpuCyclesPerScanline {
 		ppu.cycle = 0
 		ppu.scanline++
+		if ppu.scanline == 0 {
+			ppu.framePhase = int(ppu.dots * ntscSamplesPerPixel % ntscPhases)
+		}
 	}
 
-	if ppu.scanline > PpuVblankEndScanline {
+	if ppu.scanline > ppu.timing.vblankEndScanline {
 		ppu.scanline = PpuPrerenderScanline
 		ppu.frame++
 		ppu.copyFrame()
 		ret = PpuNewFrame
 	}
 
-	ppu.cycle++
+	// An NMI raised by a register write is reported on the next dot
+	if ppu.nmiPending && ret == PpuTick {
+		ppu.nmiPending = false
+		ret = PpuVblankNmi
+	}
 
 	return ret
 }
 
 func (ppu *Ppu) prerenderScanlineCycle() {
-	switch ppu.cycle {
-	case 1:
+	if ppu.cycle == 1 {
 		ppu.status.clearVblank()
+		ppu.updateNmi()
 		ppu.status.clearSprite0Hit()
 		ppu.status.clearSpriteOverflow()
-		// Better emulation would set during the right cycle (316 in last vblank scanline?)
-		ppu.oamAddr = 0x0
-	case 304:
-		if ppu.mask.showBackground() || ppu.mask.showSprites() {
-			ppu.vramAddr = ppu.vramLatch
-		}
+		// No sprites are evaluated for the first scanline
+		ppu.evalCount = 0
+		ppu.evalSprite0 = false
 	}
-}
 
-func (ppu *Ppu) renderScanlineCycle() {
-	switch ppu.cycle {
-	case 254:
-		// Better emulation would render these pixel-by-pixel to handle mid-scanline changes
-		if ppu.mask.showBackground() {
-			ppu.renderBackground()
-		}
-		if ppu.mask.showSprites() {
-			ppu.renderSprites()
+	// Fetch the first two tiles and the (unused) sprites as usual
+	if ppu.renderingEnabled() {
+		ppu.backgroundCycle()
+		if ppu.cycle >= 257 && ppu.cycle <= 320 {
+			ppu.spriteFetchCycle()
 		}
-	case 256:
-		if ppu.mask.showBackground() || ppu.mask.showSprites() {
-			ppu.updateVramAddrForScanline()
+		if ppu.cycle >= 280 && ppu.cycle <= 304 {
+			ppu.copyVertical()
 		}
 	}
 }
 
-func (ppu *Ppu) vblankScanlineCycle() bool {
-	if ppu.scanline == PpuVblankStartScanline && ppu.cycle == 1 {
-		ppu.status.setVblank()
-		if ppu.ctrl.vblankNmi() {
-			return true
+func (ppu *Ppu) renderScanlineCycle() {
+	if ppu.renderingEnabled() {
+		ppu.backgroundCycle()
+		switch {
+		case ppu.cycle >= 1 && ppu.cycle <= 256:
+			ppu.spriteEvaluationCycle()
+		case ppu.cycle >= 257 && ppu.cycle <= 320:
+			ppu.spriteFetchCycle()
 		}
 	}
-	return false
+	if ppu.cycle >= 1 && ppu.cycle <= 256 {
+		ppu.renderPixel()
+	}
 }
 
-func (ppu *Ppu) updateVramAddrForScanline() {
-	// On cycles 323 and 331 (FIXME Put after other updates?)
-	ppu.incrementCoarseXScroll()
-	ppu.incrementCoarseXScroll()
-
-	// On cycle 256
-	if ppu.vramAddr&0x7000 == 0x7000 {
-		// Increment coarse y scroll, reset fine y scroll to zero
-		sw := ppu.vramAddr & 0x3e0
-		ppu.vramAddr &= 0xfff
-		switch sw {
-		case 0x3a0:
-			ppu.vramAddr ^= 0xba0
-		case 0x3e0:
-			ppu.vramAddr ^= 0x3e0
-		default:
-			ppu.vramAddr += 0x20
+func (ppu *Ppu) vblankScanlineCycle() {
+	if ppu.scanline == ppu.timing.vblankStartScanline && ppu.cycle == 1 {
+		if !ppu.suppressVblank {
+			ppu.status.setVblank()
+			ppu.updateNmi()
 		}
-	} else {
-		// Increment fine y scroll
-		ppu.vramAddr += 0x1000
+		ppu.suppressVblank = false
 	}
-
-	// On cycle 257
-	ppu.vramAddr = (ppu.vramAddr & 0x7be0) | (ppu.vramLatch & 0x41f)
 }
 
-func (ppu *Ppu) incrementCoarseXScroll() {
-	if ppu.vramAddr&0x1f != 0x1f {
-		ppu.vramAddr++
-	} else {
-		ppu.vramAddr ^= 0x41f
+// Raises an NMI on a rising edge of the vblank flag gated by PPUCTRL bit 7
+func (ppu *Ppu) updateNmi() {
+	line := ppu.status.vblank() && ppu.ctrl.vblankNmi()
+	if line && !ppu.nmiLine {
+		ppu.nmiPending = true
 	}
+	ppu.nmiLine = line
 }
 
-func (ppu *Ppu) renderBackground() {
-	fetchTileData := func() (uint8, uint8, uint8) {
-		nametableAddr := 0x2000 | (ppu.vramAddr & 0xfff)
-		tileIndex := ppu.vram.Load(nametableAddr)
-		tileAddr := (uint16(tileIndex) << 4) | (ppu.vramAddr >> 12) | ppu.ctrl.backgroundPatternAddress()
-		tile1 := ppu.vram.Load(tileAddr)
-		tile2 := ppu.vram.Load(tileAddr + 8)
+// Returns whether vblank started on the last two dots, recently enough for a
+// register access to suppress its NMI
+func (ppu *Ppu) vblankJustStarted() bool {
+	return ppu.scanline == ppu.timing.vblankStartScanline && (ppu.cycle == 2 || ppu.cycle == 3)
+}
 
-		attrTableAddr := 0x23c0 | (ppu.vramAddr & 0xc00) | ((ppu.vramAddr >> 4) & 0x38) | ((ppu.vramAddr >> 2) & 0x7)
-		attrByteShift := ((ppu.vramAddr >> 4) & 0x4) | (ppu.vramAddr & 0x2)
-		palette := (ppu.vram.Load(attrTableAddr) >> attrByteShift) & 0x3
+func (ppu *Ppu) renderingEnabled() bool {
+	return ppu.mask.showBackground() || ppu.mask.showSprites()
+}
 
-		ppu.incrementCoarseXScroll()
+// Runs one dot of the background pipeline. Each tile takes 8 dots to fetch its
+// nametable, attribute and two pattern bytes, which are loaded into the shift
+// registers as the previous tile finishes shifting out. Dots 1-256 fetch tiles
+// 3-34 of the current scanline and dots 321-336 fetch tiles 1-2 of the next,
+// followed by two unused nametable fetches.
+func (ppu *Ppu) backgroundCycle() {
+	dot := ppu.cycle
 
-		return tile1, tile2, palette
+	if (dot >= 2 && dot <= 257) || (dot >= 322 && dot <= 337) {
+		ppu.shiftBackground()
+		if dot%8 == 1 {
+			ppu.loadBackground()
+		}
 	}
 
-	fetchPaletteEntry := func(paletteNumber, pixelValue uint8) uint8 {
-		if pixelValue == 0 {
-			return ppu.vram.palette[0]
+	if (dot >= 1 && dot <= 256) || (dot >= 321 && dot <= 336) {
+		switch dot % 8 {
+		case 1:
+			ppu.nametableByte = ppu.fetch(PpuFetchNametable, 0x2000|(ppu.vramAddr&0xfff))
+		case 3:
+			attrTableAddr := 0x23c0 | (ppu.vramAddr & 0xc00) | ((ppu.vramAddr >> 4) & 0x38) | ((ppu.vramAddr >> 2) & 0x7)
+			attrByteShift := ((ppu.vramAddr >> 4) & 0x4) | (ppu.vramAddr & 0x2)
+			ppu.attributeBits = (ppu.fetch(PpuFetchAttribute, attrTableAddr) >> attrByteShift) & 0x3
+		case 5:
+			ppu.patternLow = ppu.fetch(PpuFetchBackground, ppu.backgroundTileAddr())
+		case 7:
+			ppu.patternHigh = ppu.fetch(PpuFetchBackground, ppu.backgroundTileAddr()+8)
+		case 0:
+			ppu.incrementCoarseXScroll()
 		}
-		return ppu.vram.palette[(paletteNumber<<2)+pixelValue]
 	}
 
-	low1, high1, palette1 := fetchTileData()
-	low2, high2, palette2 := fetchTileData()
+	switch dot {
+	case 256:
+		ppu.incrementYScroll()
+	case 257:
+		ppu.copyHorizontal()
+	case 337, 339:
+		ppu.fetch(PpuFetchNametable, 0x2000|(ppu.vramAddr&0xfff))
+	}
+}
 
-	// Load the two tiles into 16-bit shift registers
-	lowShift := (uint16(low1) << 8) | uint16(low2)
-	highShift := (uint16(high1) << 8) | uint16(high2)
+func (ppu *Ppu) backgroundTileAddr() uint16 {
+	return (uint16(ppu.nametableByte) << 4) | (ppu.vramAddr >> 12) | ppu.ctrl.backgroundPatternAddress()
+}
 
-	for t := 0; t < 32; t++ {
-		for p := 0; p < 8; p++ {
-			shift := 15 - uint(p) - uint(ppu.fineScrollX)
-			pixel := (lowShift >> shift) & 1
-			pixel |= ((highShift >> shift) & 1) << 1
+func (ppu *Ppu) shiftBackground() {
+	ppu.patternShiftLow <<= 1
+	ppu.patternShiftHigh <<= 1
+	ppu.attrShiftLow <<= 1
+	ppu.attrShiftHigh <<= 1
+}
 
-			var paletteNumber = palette1
-			if shift < 8 {
-				paletteNumber = palette2
-			}
-			color := fetchPaletteEntry(paletteNumber, uint8(pixel))
-
-			pixelIndex := ppu.scanline*256 + (t * 8) + p
-			// Skip pixels already rendered
-			if ppu.pbuffer[pixelIndex].color == 0 {
-				ppu.pbuffer[pixelIndex] = PpuPixel{
-					color: color,
-					index: -1,
-				}
-			}
-		}
+func (ppu *Ppu) loadBackground() {
+	ppu.patternShiftLow = (ppu.patternShiftLow & 0xff00) | uint16(ppu.patternLow)
+	ppu.patternShiftHigh = (ppu.patternShiftHigh & 0xff00) | uint16(ppu.patternHigh)
+	ppu.attrShiftLow &= 0xff00
+	if ppu.attributeBits&1 == 1 {
+		ppu.attrShiftLow |= 0xff
+	}
+	ppu.attrShiftHigh &= 0xff00
+	if ppu.attributeBits&2 == 2 {
+		ppu.attrShiftHigh |= 0xff
+	}
+}
 
-		palette1 = palette2
+// Outputs the pixel for the current dot, choosing between the background and
+// the first opaque sprite
+func (ppu *Ppu) renderPixel() {
+	x := ppu.cycle - 1
 
-		// Shift out the first tile and bring in a new one
-		low2, high2, palette2 = fetchTileData()
-		lowShift = (lowShift << 8) | uint16(low2)
-		highShift = (highShift << 8) | uint16(high2)
+	var bgPixel, bgPalette uint8
+	if ppu.mask.showBackground() && (x >= 8 || ppu.mask.backgroundOnLeft()) {
+		shift := 15 - uint(ppu.fineScrollX)
+		bgPixel = uint8(ppu.patternShiftLow>>shift) & 1
+		bgPixel |= (uint8(ppu.patternShiftHigh>>shift) & 1) << 1
+		bgPalette = uint8(ppu.attrShiftLow>>shift) & 1
+		bgPalette |= (uint8(ppu.attrShiftHigh>>shift) & 1) << 1
 	}
-}
 
-func (ppu *Ppu) renderSprites() {
-	sprites := 0
-	for s := 0; s < 64; s++ {
-		oamBase := s * 4
+	var spritePixel uint8
+	slot := 0
+	if ppu.mask.showSprites() && (x >= 8 || ppu.mask.spritesOnLeft()) {
+		spritePixel, slot = ppu.spritePixel(x)
+	}
 
-		y := int(ppu.oam[oamBase])
-		x := int(ppu.oam[oamBase+3])
-		h := ppu.ctrl.spriteHeight()
+	if bgPixel != 0 && spritePixel != 0 && slot == 0 && ppu.spriteZero && x != 255 {
+		ppu.status.setSprite0Hit()
+	}
+
+	// Better emulation would output the palette entry addressed by the VRAM
+	// address when rendering is disabled and it points into the palette
+	color := ppu.vram.palette[0]
+	switch {
+	case spritePixel != 0 && (bgPixel == 0 || ppu.spriteAttr[slot]&0x20 == 0):
+		color = ppu.vram.palette[0x10|(ppu.spriteAttr[slot]&3)<<2+spritePixel]
+	case bgPixel != 0:
+		color = ppu.vram.palette[(bgPalette<<2)+bgPixel]
+	}
 
-		tile := uint16(ppu.oam[oamBase+1])
+	if ppu.mask.greyscale() {
+		color &= 0x30
+	}
 
-		attr := ppu.oam[oamBase+2]
-		palette := attr & 3
-		behindBackground := (attr>>5)&1 == 1
-		flipX := (attr>>6)&1 == 1
-		flipY := (attr>>7)&1 == 1
+	emphasis := ppu.mask.emphasis()
+	if ppu.timing.swapEmphasis {
+		emphasis = (emphasis & 4) | (emphasis&1)<<1 | (emphasis&2)>>1
+	}
 
-		// Sprites span (y, y+h]
-		if ppu.scanline <= y || ppu.scanline > y+h {
+	ppu.pbuffer[ppu.scanline*256+x] = PpuPixel{
+		color:    color,
+		emphasis: emphasis,
+	}
+}
+
+// Returns the first opaque sprite pixel at x and its slot, lower slots having
+// priority
+func (ppu *Ppu) spritePixel(x int) (uint8, int) {
+	for slot := 0; slot < ppu.spriteCount; slot++ {
+		offset := x - int(ppu.spriteX[slot])
+		if offset < 0 || offset > 7 {
 			continue
 		}
+		shift := uint(7 - offset)
+		pixel := (ppu.spriteLow[slot] >> shift) & 1
+		pixel |= ((ppu.spriteHigh[slot] >> shift) & 1) << 1
+		if pixel != 0 {
+			return pixel, slot
+		}
+	}
+	return 0, 0
+}
 
-		yInSprite := ppu.scanline - y - 1
-		if flipY {
-			yInSprite = h - yInSprite - 1
+// Runs one dot of sprite evaluation for the next scanline. Dots 1-64 clear
+// secondary OAM, then dots 65-256 alternate between reading a byte of OAM and
+// copying it to secondary OAM, for up to 8 sprites in range.
+func (ppu *Ppu) spriteEvaluationCycle() {
+	dot := ppu.cycle
+	if dot <= 64 {
+		if dot%2 == 0 {
+			ppu.secondaryOam[dot/2-1] = 0xff
 		}
+		return
+	}
+
+	if dot == 65 {
+		ppu.evalSprite = 0
+		ppu.evalByte = 0
+		ppu.evalCount = 0
+		ppu.evalDone = false
+		ppu.evalSprite0 = false
+	}
+	if dot%2 == 1 {
+		ppu.oamLatch = ppu.oam[ppu.evalSprite*4+ppu.evalByte]
+		return
+	}
+	if ppu.evalDone {
+		return
+	}
 
-		// Read the sprite tile data
-		var tileAddr uint16
-		switch h {
-		case 8:
-			tileAddr = ppu.ctrl.spritePatternAddress() + (tile * 16)
-		case 16:
-			tileAddr = (tile >> 1) * 32
-			if tile&1 == 1 {
-				tileAddr |= 0x1000
+	if ppu.evalCount < 8 {
+		ppu.secondaryOam[ppu.evalCount*4+ppu.evalByte] = ppu.oamLatch
+		if ppu.evalByte == 0 {
+			if !ppu.spriteInRange(ppu.oamLatch) {
+				ppu.nextEvalSprite()
+				return
 			}
-			if yInSprite >= 8 {
-				tileAddr += 16
-				yInSprite -= 8
+			if ppu.evalSprite == 0 {
+				ppu.evalSprite0 = true
 			}
 		}
+		ppu.evalByte++
+		if ppu.evalByte == 4 {
+			ppu.evalByte = 0
+			ppu.evalCount++
+			ppu.nextEvalSprite()
+		}
+		return
+	}
 
-		tileData1 := ppu.vram.Load(tileAddr + uint16(yInSprite))
-		tileData2 := ppu.vram.Load(tileAddr + uint16(yInSprite) + 8)
+	// With secondary OAM full, the hardware keeps looking for a sprite in range
+	// to set the overflow flag but wrongly advances the byte along with the
+	// sprite, so it checks the wrong bytes as y coordinates
+	if ppu.spriteInRange(ppu.oamLatch) {
+		ppu.status.setSpriteOverflow()
+		ppu.evalDone = true
+		return
+	}
+	ppu.evalByte = (ppu.evalByte + 1) & 3
+	ppu.nextEvalSprite()
+}
 
-		// Render the sprite
-		for p := 0; p < 8; p++ {
-			pixel := (tileData1 >> uint(p)) & 1
-			pixel |= ((tileData2 >> uint(p)) & 1) << 1
+func (ppu *Ppu) nextEvalSprite() {
+	ppu.evalSprite++
+	if ppu.evalSprite == 64 {
+		ppu.evalSprite = 0
+		ppu.evalDone = true
+	}
+}
 
-			// Skip rendering transparent pixels
-			if pixel == 0 {
-				continue
-			}
+func (ppu *Ppu) spriteInRange(y uint8) bool {
+	row := ppu.scanline - int(y)
+	return row >= 0 && row < ppu.ctrl.spriteHeight()
+}
 
-			frameX := x + (7 - p)
-			if flipX {
-				frameX = x + p
-			}
+// Runs one dot of the sprite fetches for the next scanline. Each of the 8 slots
+// takes 8 dots to read its secondary OAM entry and fetch two pattern bytes;
+// empty slots fetch tile 0xff and discard it.
+func (ppu *Ppu) spriteFetchCycle() {
+	// OAMADDR is held at zero while fetching
+	ppu.oamAddr = 0
 
-			pixelIndex := ppu.scanline*256 + frameX
+	if ppu.cycle == 257 {
+		ppu.spriteCount = ppu.evalCount
+		ppu.spriteZero = ppu.evalSprite0
+	}
 
-			// Skip rendering outside the frame
-			if frameX > 255 || pixelIndex >= len(ppu.pbuffer) {
-				continue
-			}
+	slot := (ppu.cycle - 257) / 8
+	sprite := ppu.secondaryOam[slot*4 : slot*4+4]
+	switch (ppu.cycle - 257) % 8 {
+	case 4:
+		ppu.spriteLow[slot] = ppu.fetch(PpuFetchSprite, ppu.spriteTileAddr(sprite))
+	case 6:
+		ppu.spriteHigh[slot] = ppu.fetch(PpuFetchSprite, ppu.spriteTileAddr(sprite)+8)
+		ppu.spriteAttr[slot] = sprite[2]
+		ppu.spriteX[slot] = sprite[3]
+
+		if slot >= ppu.spriteCount {
+			ppu.spriteLow[slot] = 0
+			ppu.spriteHigh[slot] = 0
+		} else if sprite[2]&0x40 == 0x40 {
+			ppu.spriteLow[slot] = reverseBits(ppu.spriteLow[slot])
+			ppu.spriteHigh[slot] = reverseBits(ppu.spriteHigh[slot])
+		}
+	}
+}
 
-			// Check for sprite-0 hit before any other early-outs
-			if ppu.pbuffer[pixelIndex].color != 0 && s == 0 {
-				ppu.status.setSprite0Hit()
-			}
+// Returns the address of the pattern row for the sprite on the next scanline
+func (ppu *Ppu) spriteTileAddr(sprite []uint8) uint16 {
+	h := ppu.ctrl.spriteHeight()
+	tile := uint16(sprite[1])
+	row := (ppu.scanline - int(sprite[0])) & (h - 1)
+	if sprite[2]&0x80 == 0x80 {
+		row = h - row - 1
+	}
 
-			// Skip rendering sprites of lower priority over sprites of higher priority
-			if ppu.pbuffer[pixelIndex].index > -1 && ppu.pbuffer[pixelIndex].index < s {
-				continue
-			}
+	var tileAddr uint16
+	switch h {
+	case 8:
+		tileAddr = ppu.ctrl.spritePatternAddress() + (tile * 16)
+	case 16:
+		tileAddr = (tile >> 1) * 32
+		if tile&1 == 1 {
+			tileAddr |= 0x1000
+		}
+		if row >= 8 {
+			tileAddr += 16
+			row -= 8
+		}
+	}
+	return tileAddr + uint16(row)
+}
 
-			// Skip rendering behind-background priority with non-transparent pixels
-			if ppu.pbuffer[pixelIndex].color != 0 && behindBackground {
-				continue
-			}
+func reverseBits(b uint8) uint8 {
+	b = (b&0xf0)>>4 | (b&0x0f)<<4
+	b = (b&0xcc)>>2 | (b&0x33)<<2
+	b = (b&0xaa)>>1 | (b&0x55)<<1
+	return b
+}
 
-			color := ppu.vram.palette[0x10|(palette<<2)+pixel]
-			ppu.pbuffer[pixelIndex] = PpuPixel{
-				color: color,
-				index: s,
-			}
-		}
+func (ppu *Ppu) incrementCoarseXScroll() {
+	if ppu.vramAddr&0x1f != 0x1f {
+		ppu.vramAddr++
+	} else {
+		ppu.vramAddr ^= 0x41f
+	}
+}
 
-		sprites++
-		if sprites > 8 {
-			ppu.status.setSpriteOverflow()
-			break
+func (ppu *Ppu) incrementYScroll() {
+	if ppu.vramAddr&0x7000 == 0x7000 {
+		// Increment coarse y scroll, reset fine y scroll to zero
+		sw := ppu.vramAddr & 0x3e0
+		ppu.vramAddr &= 0xfff
+		switch sw {
+		case 0x3a0:
+			ppu.vramAddr ^= 0xba0
+		case 0x3e0:
+			ppu.vramAddr ^= 0x3e0
+		default:
+			ppu.vramAddr += 0x20
 		}
+	} else {
+		// Increment fine y scroll
+		ppu.vramAddr += 0x1000
 	}
 }
 
+// Copies coarse x scroll and the horizontal nametable bit from the latch
+func (ppu *Ppu) copyHorizontal() {
+	ppu.vramAddr = (ppu.vramAddr & 0x7be0) | (ppu.vramLatch & 0x41f)
+}
+
+// Copies coarse and fine y scroll and the vertical nametable bit from the latch
+func (ppu *Ppu) copyVertical() {
+	ppu.vramAddr = (ppu.vramAddr & 0x41f) | (ppu.vramLatch & 0x7be0)
+}
+
 func (ppu *Ppu) copyFrame() {
+	if ppu.ntsc != nil {
+		ppu.ntsc.Apply(ppu.pbuffer, ppu.Framebuffer, ppu.framePhase)
+		return
+	}
 	for i, pixel := range ppu.pbuffer {
-		// Compute the RGB color
-		rgb := paletteRgb[pixel.color]
-		ppu.Framebuffer[i].R = uint8((rgb >> 16) & 0xff)
-		ppu.Framebuffer[i].G = uint8((rgb >> 8) & 0xff)
-		ppu.Framebuffer[i].B = uint8(rgb & 0xff)
-
-		// Reset the internal pixels for the next frame
-		ppu.pbuffer[i].color = 0
-		ppu.pbuffer[i].index = -1
+		ppu.Framebuffer[i] = ppu.Palette.Color(pixel)
 	}
 }
 
+// Renders frames through the NTSC filter, which replaces the palette and widens
+// the Framebuffer to NtscWidth
+func (ppu *Ppu) EnableNtscFilter() {
+	ppu.ntsc = NewNtscFilter()
+	ppu.Framebuffer = make([]Pixel, NtscWidth*ScreenHeight)
+}
+
+// Returns the width of the Framebuffer in pixels
+func (ppu *Ppu) FrameWidth() int {
+	return len(ppu.Framebuffer) / ScreenHeight
+}
+
 func (ppu *Ppu) Load(addr uint16) uint8 {
 	switch addr & 7 {
 	case 2:
-		return ppu.readStatus()
+		// Only the flags are driven; the low bits come from the I/O latch
+		return ppu.driveLatch(ppu.readStatus(), 0xe0)
 	case 4:
-		return ppu.readOamData()
+		return ppu.driveLatch(ppu.readOamData(), 0xff)
 	case 7:
-		return ppu.readData()
+		if ppu.vramAddr&0x3fff >= 0x3f00 {
+			// Palette entries are 6 bits
+			return ppu.driveLatch(ppu.readData(), 0x3f)
+		}
+		return ppu.driveLatch(ppu.readData(), 0xff)
+	}
+	// Write-only registers read back the I/O latch
+	return ppu.decayLatch()
+}
+
+// Drives the bits in mask onto the I/O latch and returns the latch
+func (ppu *Ppu) driveLatch(val uint8, mask uint8) uint8 {
+	ppu.decayLatch()
+	ppu.ioLatch = (ppu.ioLatch &^ mask) | (val & mask)
+	for bit := range ppu.ioLatchRefreshed {
+		if mask&(1<<uint(bit)) != 0 {
+			ppu.ioLatchRefreshed[bit] = ppu.dots
+		}
+	}
+	return ppu.ioLatch
+}
+
+// Clears the I/O latch bits that have not been driven recently and returns
+// the latch
+func (ppu *Ppu) decayLatch() uint8 {
+	for bit, refreshed := range ppu.ioLatchRefreshed {
+		if ppu.dots-refreshed > ppuOpenBusDecayDots {
+			ppu.ioLatch &^= 1 << uint(bit)
+		}
 	}
-	// Better emulation would simulate the bus hold-up between the PPU and CPU
-	// that causes the last value written to be readable for ~600ms
-	return 0
+	return ppu.ioLatch
 }
 
 func (ppu *Ppu) Store(addr uint16, val uint8) {
+	ppu.driveLatch(val, 0xff)
 	switch addr & 7 {
 	case 0:
 		ppu.writeCtrl(val)
@@ -396,15 +637,41 @@ func (ppu *Ppu) Store(addr uint16, val uint8) {
 func (ppu *Ppu) readStatus() uint8 {
 	ppu.writeLatch = false
 
-	// Better emulation would drop the vblank flag and suppress NMIs when the
-	// status is read at the exact start of vblank
+	// Reading one dot before vblank starts suppresses the flag for the frame,
+	// and reading as it starts returns the flag but suppresses the NMI
+	if ppu.scanline == ppu.timing.vblankStartScanline && ppu.cycle == 1 {
+		ppu.suppressVblank = true
+	}
+	if ppu.vblankJustStarted() {
+		ppu.nmiCancelled = true
+	}
+
 	status := uint8(ppu.status)
 	ppu.status.clearVblank()
+	ppu.updateNmi()
 
 	return status
 }
 
 func (ppu *Ppu) readOamData() uint8 {
+	// While rendering, OAMDATA exposes the sprite evaluation and fetch bus
+	if ppu.renderingEnabled() && ppu.scanline < PpuQuietScanline {
+		switch {
+		case ppu.cycle >= 1 && ppu.cycle <= 64 && ppu.scanline >= 0:
+			return 0xff // Secondary OAM is being cleared
+		case ppu.cycle >= 65 && ppu.cycle <= 256 && ppu.scanline >= 0:
+			return ppu.oamLatch
+		case ppu.cycle >= 257 && ppu.cycle <= 320:
+			// Each slot reads y, tile, attributes, then x for the remaining dots
+			offset := (ppu.cycle - 257) % 8
+			if offset > 3 {
+				offset = 3
+			}
+			return ppu.secondaryOam[(ppu.cycle-257)/8*4+offset]
+		default:
+			return ppu.secondaryOam[0]
+		}
+	}
 	return ppu.oam[ppu.oamAddr]
 }
 
@@ -417,13 +684,22 @@ func (ppu *Ppu) readData() uint8 {
 		// For palette reads the buffer is still populated with a value
 		ppu.readBuffer = ppu.vram.Load(ppu.vramAddr - 0x1000)
 	}
+	ppu.watchAddress(ppu.vramAddr)
 	ppu.vramAddr += ppu.ctrl.vramAddrInc()
+	ppu.watchAddress(ppu.vramAddr)
 	return data
 }
 
 func (ppu *Ppu) writeCtrl(val uint8) {
 	ppu.ctrl = PpuCtrlReg(val)
 	ppu.vramLatch = (ppu.vramLatch & 0xf3ff) | ((uint16(val) & 3) << 10)
+
+	// Enabling NMI during vblank raises one immediately, and disabling it as
+	// vblank starts suppresses it
+	ppu.updateNmi()
+	if !ppu.ctrl.vblankNmi() && ppu.vblankJustStarted() {
+		ppu.nmiCancelled = true
+	}
 }
 
 func (ppu *Ppu) writeMask(val uint8) {
@@ -459,6 +735,7 @@ func (ppu *Ppu) writeAddr(val uint8) {
 	} else {
 		ppu.vramLatch = (ppu.vramLatch & 0xff00) | uint16(val)
 		ppu.vramAddr = ppu.vramLatch
+		ppu.watchAddress(ppu.vramAddr)
 	}
 	ppu.writeLatch = !ppu.writeLatch
 }
@@ -466,29 +743,66 @@ func (ppu *Ppu) writeAddr(val uint8) {
 func (ppu *Ppu) writeData(val uint8) {
 	ppu.vram.Store(ppu.vramAddr, val)
 	ppu.vramAddr += ppu.ctrl.vramAddrInc()
+	ppu.watchAddress(ppu.vramAddr)
 }
 
 type VramMemoryMap struct {
-	mapper     Mapper
-	nametables [2][0x400]uint8
-	palette    [0x20]uint8
+	mapper          Mapper
+	nametableMapper NametableMapper // Optional
+	fourScreen      bool            // Cartridge RAM for pages 2 and 3 overrides the mapper mirroring
+	nametables      [4][0x400]uint8 // Console RAM in pages 0 and 1, four-screen RAM in 2 and 3
+	palette         [0x20]uint8
+
+	// The mirroring, cached per quadrant of 0x2000-0x2fff
+	quadrantPages [4]int
+	quadrantRam   [4]*[0x400]uint8 // Nil where the mapper supplies the page
 }
 
+func NewVramMemoryMap(mapper Mapper) *VramMemoryMap {
+	mem := &VramMemoryMap{mapper: mapper}
+	mem.nametableMapper, _ = mapper.(NametableMapper)
+	mem.updateMirroring()
+	return mem
+}
+
+func (mem *VramMemoryMap) setFourScreen(fourScreen bool) {
+	mem.fourScreen = fourScreen
+	mem.updateMirroring()
+}
+
+// Selects a 1 KB page of nametable memory for each quadrant of 0x2000-0x2fff,
+// two bits per quadrant starting from the low bits. Pages 0 and 1 are the
+// console RAM; pages 2 and 3 are on the cartridge.
+type Mirroring uint8
+
 const (
-	MirrorVertical = iota
-	MirrorHorizontal
-	MirrorSingleUpper
-	MirrorSingleLower
+	MirrorVertical    Mirroring = 0x44 // 0, 1, 0, 1
+	MirrorHorizontal  Mirroring = 0x50 // 0, 0, 1, 1
+	MirrorSingleUpper Mirroring = 0x00 // 0, 0, 0, 0
+	MirrorSingleLower Mirroring = 0x55 // 1, 1, 1, 1
+	MirrorFourScreen  Mirroring = 0xe4 // 0, 1, 2, 3
 )
 
-type Mirroring int
+// Returns the page mapped at a nametable address
+func (mirroring Mirroring) page(addr uint16) int {
+	return int(mirroring>>((addr>>9)&6)) & 3
+}
 
-// Maps logical nametables to physical nametables based on the mirroring configuration
-var nametableMirroring = map[Mirroring][4]int{
-	MirrorVertical:    {0, 1, 0, 1},
-	MirrorHorizontal:  {0, 0, 1, 1},
-	MirrorSingleUpper: {0, 0, 0, 0},
-	MirrorSingleLower: {1, 1, 1, 1},
+// Caches the nametable memory of each quadrant. Called after the mapper may
+// have changed its mirroring.
+func (mem *VramMemoryMap) updateMirroring() {
+	mirroring := MirrorFourScreen
+	if !mem.fourScreen {
+		mirroring = mem.mapper.Mirroring()
+	}
+	for q := range mem.quadrantPages {
+		page := mirroring.page(0x2000 + uint16(q)*0x400)
+		mem.quadrantPages[q] = page
+		mem.quadrantRam[q] = &mem.nametables[page]
+		if page >= 2 && mem.nametableMapper != nil {
+			mem.quadrantRam[q] = nil
+		}
+	}
 }
 
 func (mem *VramMemoryMap) Load(addr uint16) uint8 {
@@ -496,8 +810,11 @@ func (mem *VramMemoryMap) Load(addr uint16) uint8 {
 	case addr < 0x2000:
 		return mem.mapper.LoadChr(addr)
 	case addr < 0x3f00:
-		nametable := nametableMirroring[mem.mapper.Mirroring()][(addr&0xc00)>>10]
-		return mem.nametables[nametable][addr&0x3ff]
+		q := (addr >> 10) & 3
+		if ram := mem.quadrantRam[q]; ram != nil {
+			return ram[addr&0x3ff]
+		}
+		return mem.nametableMapper.LoadNametable(mem.quadrantPages[q], addr&0xfff)
 	case addr < 0x4000:
 		return mem.palette[addr&0x1f]
 	}
@@ -509,8 +826,12 @@ func (mem *VramMemoryMap) Store(addr uint16, val uint8) {
 	case addr < 0x2000:
 		mem.mapper.StoreChr(addr, val)
 	case addr < 0x3f00:
-		nametable := nametableMirroring[mem.mapper.Mirroring()][(addr&0xc00)>>10]
-		mem.nametables[nametable][addr&0x3ff] = val
+		q := (addr >> 10) & 3
+		if ram := mem.quadrantRam[q]; ram != nil {
+			ram[addr&0x3ff] = val
+			return
+		}
+		mem.nametableMapper.StoreNametable(mem.quadrantPages[q], addr&0xfff, val)
 	case addr < 0x4000:
 		if addr&0xf == 0 {
 			mem.palette[0x00] = val
@@ -562,14 +883,17 @@ func (ctrl PpuCtrlReg) vblankNmi() bool {
 	return (ctrl>>7)&1 == 1
 }
 
-func (mask PpuMaskReg) backgroundOnLeft() bool { return mask&1 == 1 }
-func (mask PpuMaskReg) spritesOnLeft() bool    { return (mask>>1)&1 == 1 }
+func (mask PpuMaskReg) greyscale() bool        { return mask&1 == 1 }
+func (mask PpuMaskReg) backgroundOnLeft() bool { return (mask>>1)&1 == 1 }
+func (mask PpuMaskReg) spritesOnLeft() bool    { return (mask>>2)&1 == 1 }
 func (mask PpuMaskReg) showBackground() bool   { return (mask>>3)&1 == 1 }
 func (mask PpuMaskReg) showSprites() bool      { return (mask>>4)&1 == 1 }
+func (mask PpuMaskReg) emphasis() uint8        { return uint8(mask >> 5) }
 
 func (status *PpuStatusReg) setSpriteOverflow()   { *status |= 0x20 }
 func (status *PpuStatusReg) clearSpriteOverflow() { *status &= 0xdf }
 func (status *PpuStatusReg) setSprite0Hit()       { *status |= 0x40 }
 func (status *PpuStatusReg) clearSprite0Hit()     { *status &= 0xbf }
 func (status *PpuStatusReg) setVblank()           { *status |= 0x80 }
+func (status PpuStatusReg) vblank() bool          { return status&0x80 == 0x80 }
 func (status *PpuStatusReg) clearVblank()         { *status &= 0x7f }
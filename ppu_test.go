@@ -0,0 +1,317 @@
+package main
+
+import "testing"
+
+// Returns a PPU with CHR RAM where tile 1 is solid color 1 and tile 0 is blank
+func newTestPpu() *Ppu {
+	rom := newTestRom(1, 1)
+	rom.header.Flags6 = 1 // Vertical mirroring
+	for i := 0x10; i < 0x18; i++ {
+		rom.chr[i] = 0xff
+	}
+
+	ppu := &Ppu{vram: NewVramMemoryMap(NewNrom(rom))}
+	ppu.Setup()
+	ppu.vram.palette[0] = 0x0f
+	ppu.vram.palette[1] = 0x30
+	return ppu
+}
+
+// Steps the PPU until it is about to run the given dot
+func stepPpuTo(ppu *Ppu, scanline, cycle int) {
+	for ppu.scanline != scanline || ppu.cycle != cycle {
+		ppu.Step()
+	}
+}
+
+func TestPpuBackgroundFineScroll(t *testing.T) {
+	ppu := newTestPpu()
+	ppu.vram.Store(0x2001, 1) // Second tile of the top-left nametable
+	ppu.writeScroll(3)
+	ppu.writeScroll(0)
+	ppu.writeMask(0x0a)
+
+	stepPpuTo(ppu, 1, 0)
+	for x := 0; x < 16; x++ {
+		expected := uint8(0x0f)
+		if x >= 5 && x < 13 {
+			expected = 0x30
+		}
+		if got := ppu.pbuffer[x].color; got != expected {
+			t.Errorf("Pixel %d %#x, expected %#x", x, got, expected)
+		}
+	}
+}
+
+func TestPpuMidScanlineAddressWrite(t *testing.T) {
+	ppu := newTestPpu()
+	for addr := uint16(0x2400); addr < 0x27c0; addr++ {
+		ppu.vram.Store(addr, 1)
+	}
+	ppu.writeMask(0x0a)
+
+	// Point the VRAM address at the solid nametable halfway across the scanline
+	stepPpuTo(ppu, 0, 128)
+	ppu.writeAddr(0x24)
+	ppu.writeAddr(0x10)
+
+	stepPpuTo(ppu, 1, 0)
+	if got := ppu.pbuffer[0].color; got != 0x0f {
+		t.Errorf("Pixel 0 %#x, expected 0x0f", got)
+	}
+	if got := ppu.pbuffer[255].color; got != 0x30 {
+		t.Errorf("Pixel 255 %#x, expected 0x30", got)
+	}
+}
+
+func TestPpuSpriteOverflow(t *testing.T) {
+	ppu := newTestPpu()
+	ppu.vram.palette[0x11] = 0x16
+	for s := 0; s < 9; s++ {
+		copy(ppu.oam[s*4:], []uint8{10, 1, 0, uint8(s * 16)})
+	}
+	for s := 9; s < 64; s++ {
+		ppu.oam[s*4] = 0xff
+	}
+	ppu.writeMask(0x1e)
+
+	stepPpuTo(ppu, 11, 0)
+	if ppu.status&0x20 == 0 {
+		t.Error("Overflow not set with 9 sprites on a scanline")
+	}
+
+	// Only the first 8 sprites are drawn
+	stepPpuTo(ppu, 12, 0)
+	for s := 0; s < 9; s++ {
+		expected := uint8(0x16)
+		if s == 8 {
+			expected = 0x0f
+		}
+		if got := ppu.pbuffer[11*256+s*16].color; got != expected {
+			t.Errorf("Sprite %d pixel %#x, expected %#x", s, got, expected)
+		}
+	}
+}
+
+func TestPpuSprite0HitTiming(t *testing.T) {
+	ppu := newTestPpu()
+	ppu.vram.Store(0x2000, 1)
+	copy(ppu.oam[:], []uint8{3, 1, 0, 4})
+	for s := 1; s < 64; s++ {
+		ppu.oam[s*4] = 0xff
+	}
+	ppu.writeMask(0x1e)
+
+	// The sprite starts on scanline 4 at x = 4, drawn on dot 5
+	stepPpuTo(ppu, 4, 5)
+	if ppu.status&0x40 != 0 {
+		t.Fatal("Sprite 0 hit set early")
+	}
+	ppu.Step()
+	if ppu.status&0x40 == 0 {
+		t.Fatal("Sprite 0 hit not set")
+	}
+}
+
+func TestPpuMaskClippingAndGreyscale(t *testing.T) {
+	ppu := newTestPpu()
+	ppu.vram.palette[1] = 0x16
+	ppu.vram.Store(0x2000, 1)
+	ppu.vram.Store(0x2001, 1)
+	ppu.writeMask(0x09) // Background without the left column, greyscale
+
+	stepPpuTo(ppu, 1, 0)
+	if got := ppu.pbuffer[0].color; got != 0x0f&0x30 {
+		t.Errorf("Clipped pixel %#x, expected %#x", got, 0x0f&0x30)
+	}
+	if got := ppu.pbuffer[8].color; got != 0x16&0x30 {
+		t.Errorf("Greyscale pixel %#x, expected %#x", got, 0x16&0x30)
+	}
+
+	ppu.writeMask(0xe8) // All emphasis bits
+	stepPpuTo(ppu, 2, 0)
+	if got := ppu.pbuffer[256].emphasis; got != 7 {
+		t.Errorf("Pixel emphasis %d, expected 7", got)
+	}
+}
+
+func TestPpuOddFrameSkip(t *testing.T) {
+	for _, test := range []struct {
+		mask uint8
+		dots [2]int
+	}{{0x00, [2]int{89342, 89342}}, {0x08, [2]int{89341, 89342}}} {
+		ppu := newTestPpu()
+		ppu.writeMask(test.mask)
+		for ppu.Step() != PpuNewFrame {
+		}
+
+		// The frame just started is odd
+		for i, expected := range test.dots {
+			dots := 1
+			for ppu.Step() != PpuNewFrame {
+				dots++
+			}
+			if dots != expected {
+				t.Errorf("Mask %x frame %d took %d dots, expected %d", test.mask, i, dots, expected)
+			}
+		}
+	}
+}
+
+func TestPpuVblankReadRace(t *testing.T) {
+	// Reading just before vblank suppresses the flag and NMI for the frame
+	ppu := newTestPpu()
+	ppu.writeCtrl(0x80)
+	stepPpuTo(ppu, ppu.timing.vblankStartScanline, 1)
+	if status := ppu.readStatus(); status&0x80 != 0 {
+		t.Errorf("Status %x read before vblank has the flag set", status)
+	}
+	for i := 0; i < 10; i++ {
+		if ppu.Step() == PpuVblankNmi {
+			t.Fatal("NMI after suppressing read")
+		}
+	}
+	if ppu.status.vblank() {
+		t.Error("Vblank flag set after suppressing read")
+	}
+
+	// Reading as vblank starts returns the flag but cancels the NMI
+	ppu = newTestPpu()
+	ppu.writeCtrl(0x80)
+	stepPpuTo(ppu, ppu.timing.vblankStartScanline, 1)
+	if ppu.Step() != PpuVblankNmi {
+		t.Fatal("No NMI at vblank start")
+	}
+	if status := ppu.readStatus(); status&0x80 == 0 || !ppu.nmiCancelled {
+		t.Errorf("Status %x read at vblank start, NMI cancelled %v", status, ppu.nmiCancelled)
+	}
+}
+
+func TestPpuNmiEnabledDuringVblank(t *testing.T) {
+	ppu := newTestPpu()
+	stepPpuTo(ppu, ppu.timing.vblankStartScanline+1, 0)
+	ppu.writeCtrl(0x80)
+	if ppu.Step() != PpuVblankNmi {
+		t.Error("No NMI when enabled during vblank")
+	}
+
+	// No second NMI once the flag is cleared
+	ppu.readStatus()
+	ppu.writeCtrl(0x00)
+	ppu.writeCtrl(0x80)
+	if ppu.Step() != PpuTick {
+		t.Error("NMI with the vblank flag clear")
+	}
+}
+
+func TestPpuOpenBus(t *testing.T) {
+	ppu := newTestPpu()
+	ppu.Store(0x2000, 0x1f) // Also the last value on the I/O latch
+	ppu.Store(0x2003, 0xa5)
+
+	if got := ppu.Load(0x2005); got != 0xa5 {
+		t.Errorf("Write-only read %#x, expected 0xa5", got)
+	}
+	ppu.status = 0x80
+	if got := ppu.Load(0x2002); got != 0x85 {
+		t.Errorf("Status read %#x, expected 0x85", got)
+	}
+
+	// Palette reads only drive the low 6 bits
+	ppu.Store(0x2006, 0x3f)
+	ppu.Store(0x2006, 0x01)
+	if got := ppu.Load(0x2007); got != 0x30 {
+		t.Errorf("Palette read %#x, expected 0x30", got)
+	}
+	ppu.Store(0x2006, 0x3f)
+	ppu.Store(0x2006, 0x01)
+	ppu.Store(0x2003, 0xc0)
+	if got := ppu.Load(0x2007); got != 0xf0 {
+		t.Errorf("Palette read with 0xc0 latched %#x, expected 0xf0", got)
+	}
+
+	ppu.Store(0x2000, 0xff)
+	ppu.dots += ppuOpenBusDecayDots + 1
+	if got := ppu.Load(0x2000); got != 0 {
+		t.Errorf("Read after decay %#x, expected 0", got)
+	}
+}
+
+func TestPpuOamReadDuringRendering(t *testing.T) {
+	ppu := newTestPpu()
+	copy(ppu.oam[:], []uint8{10, 1, 2, 3})
+	for s := 1; s < 64; s++ {
+		ppu.oam[s*4] = 0xff
+	}
+	ppu.writeMask(0x18)
+
+	stepPpuTo(ppu, 11, 10)
+	if got := ppu.Load(0x2004); got != 0xff {
+		t.Errorf("Read while clearing %#x, expected 0xff", got)
+	}
+	stepPpuTo(ppu, 11, 257+2)
+	if got := ppu.Load(0x2004); got != 2 {
+		t.Errorf("Read while fetching attributes %#x, expected 2", got)
+	}
+	stepPpuTo(ppu, 11, 257+6)
+	if got := ppu.Load(0x2004); got != 3 {
+		t.Errorf("Read while fetching patterns %#x, expected 3", got)
+	}
+
+	ppu.writeMask(0)
+	ppu.writeOamAddr(1)
+	if got := ppu.Load(0x2004); got != 1 {
+		t.Errorf("Read with rendering disabled %#x, expected 1", got)
+	}
+}
+
+func TestVramMirroring(t *testing.T) {
+	cases := []struct {
+		mirroring Mirroring
+		pages     [4]int
+	}{
+		{MirrorVertical, [4]int{0, 1, 0, 1}},
+		{MirrorHorizontal, [4]int{0, 0, 1, 1}},
+		{MirrorSingleUpper, [4]int{0, 0, 0, 0}},
+		{MirrorSingleLower, [4]int{1, 1, 1, 1}},
+		{MirrorFourScreen, [4]int{0, 1, 2, 3}},
+		{Mirroring(0x1b), [4]int{3, 2, 1, 0}},
+	}
+	for _, c := range cases {
+		for q, expected := range c.pages {
+			if got := c.mirroring.page(0x2000 + uint16(q)*0x400 + 0x123); got != expected {
+				t.Errorf("Mirroring %#x quadrant %d page %d, expected %d", c.mirroring, q, got, expected)
+			}
+		}
+	}
+}
+
+func TestVramFourScreen(t *testing.T) {
+	ppu := newTestPpu()
+	ppu.vram.setFourScreen(true)
+	for q := uint16(0); q < 4; q++ {
+		ppu.vram.Store(0x2000+q*0x400, uint8(q+1))
+	}
+	for q := uint16(0); q < 4; q++ {
+		if got := ppu.vram.Load(0x3000 + q*0x400); got != uint8(q+1) {
+			t.Errorf("Quadrant %d %d, expected %d", q, got, q+1)
+		}
+	}
+}
+
+func TestVramMirroringFollowsMapper(t *testing.T) {
+	rom := newTestRom(8, 0)
+	rom.header.Flags6 = 0x70 // AxROM
+	nes := NewNes(rom)
+	nes.ppu.vram.Store(0x2000, 1)
+
+	// Switching to the other single-screen page through the CPU bus
+	nes.mem.Store(0x8000, 0x10)
+	if got := nes.ppu.vram.Load(0x2400); got != 0 {
+		t.Errorf("Nametable after switching pages %d, expected 0", got)
+	}
+	nes.mem.Store(0x8000, 0)
+	if got := nes.ppu.vram.Load(0x2400); got != 1 {
+		t.Errorf("Nametable after switching back %d, expected 1", got)
+	}
+}
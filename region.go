@@ -0,0 +1,92 @@
+package main
+
+import "fmt"
+
+type Region int
+
+const (
+	RegionNtsc Region = iota
+	RegionPal
+	RegionDendy // Famiclones with PAL frame timing and an NTSC-like CPU
+	RegionMax
+)
+
+var regionNames = [RegionMax]string{"ntsc", "pal", "dendy"}
+
+func (region Region) String() string { return regionNames[region] }
+
+func ParseRegion(name string) (Region, error) {
+	for region, regionName := range regionNames {
+		if name == regionName {
+			return Region(region), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown region %q", name)
+}
+
+const (
+	NtscCpuFrequency  = 1789773
+	PalCpuFrequency   = 1662607
+	DendyCpuFrequency = 1773448
+
+	NtscFrameRate = 60.0988
+	PalFrameRate  = 50.0070
+)
+
+// Timing and hardware differences between regions
+type RegionTiming struct {
+	cpuFrequency int
+	frameRate    float64
+	ppuDots      int // PPU dots per 5 CPU cycles
+
+	// Scanlines are numbered from the pre-render scanline at -1
+	vblankStartScanline int
+	vblankEndScanline   int  // The last scanline of the frame
+	swapEmphasis        bool // PAL swaps the red and green emphasis bits
+	skipOddDot          bool // NTSC shortens odd frames by a dot
+
+	// APU tables, in CPU cycles
+	frameSteps   [5]int
+	noisePeriods *[16]uint16
+	dmcPeriods   *[16]uint16
+}
+
+var regionTimings = [RegionMax]RegionTiming{
+	RegionNtsc: {
+		cpuFrequency:        NtscCpuFrequency,
+		frameRate:           NtscFrameRate,
+		ppuDots:             15,
+		vblankStartScanline: 241,
+		vblankEndScanline:   260,
+		skipOddDot:          true,
+		frameSteps:          ntscFrameSteps,
+		noisePeriods:        &ntscNoisePeriods,
+		dmcPeriods:          &ntscDmcPeriods,
+	},
+	RegionPal: {
+		cpuFrequency:        PalCpuFrequency,
+		frameRate:           PalFrameRate,
+		ppuDots:             16,
+		vblankStartScanline: 241,
+		vblankEndScanline:   310,
+		swapEmphasis:        true,
+		frameSteps:          palFrameSteps,
+		noisePeriods:        &palNoisePeriods,
+		dmcPeriods:          &palDmcPeriods,
+	},
+	RegionDendy: {
+		// Vblank starts 50 scanlines late so NTSC games keep their vblank time
+		cpuFrequency:        DendyCpuFrequency,
+		frameRate:           PalFrameRate,
+		ppuDots:             15,
+		vblankStartScanline: 291,
+		vblankEndScanline:   310,
+		frameSteps:          ntscFrameSteps,
+		noisePeriods:        &ntscNoisePeriods,
+		dmcPeriods:          &ntscDmcPeriods,
+	},
+}
+
+func (region Region) Timing() *RegionTiming { return &regionTimings[region] }
+
+func (timing *RegionTiming) FrameRate() float64 { return timing.frameRate }
@@ -0,0 +1,41 @@
+package main
+
+import "testing"
+
+func TestRegionFrameLength(t *testing.T) {
+	for _, test := range []struct {
+		region Region
+		cycles uint64 // CPU cycles per frame
+	}{{RegionNtsc, 29781}, {RegionPal, 33248}, {RegionDendy, 35464}} {
+		rom := newTestRom(1, 1)
+		copy(rom.prg, []uint8{0x4c, 0x00, 0x80}) // JMP $8000
+		rom.prg[ResetVector&0x3fff+1] = 0x80
+		nes := NewNes(rom)
+		nes.SetRegion(test.region)
+
+		for !nes.Step() {
+		}
+		start := nes.cpu.cycles
+		for !nes.Step() {
+		}
+		if cycles := nes.cpu.cycles - start; cycles+3 < test.cycles || cycles > test.cycles+3 {
+			t.Errorf("%v frame took %v CPU cycles, expected %v", test.region, cycles, test.cycles)
+		}
+	}
+}
+
+func TestRomRegion(t *testing.T) {
+	rom := newTestRom(1, 1)
+	if region := rom.Region(); region != RegionNtsc {
+		t.Errorf("Default region %v, expected ntsc", region)
+	}
+	rom.header.Flags9 = 1
+	if region := rom.Region(); region != RegionPal {
+		t.Errorf("iNES region %v, expected pal", region)
+	}
+	rom.header.Flags7 = 0x08 // NES 2.0
+	rom.header.Flags12 = 3
+	if region := rom.Region(); region != RegionDendy {
+		t.Errorf("NES 2.0 region %v, expected dendy", region)
+	}
+}
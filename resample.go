@@ -0,0 +1,143 @@
+package main
+
+import "math"
+
+// Converts the APU output, which changes at the CPU clock rate, to the host
+// sample rate with band-limited step synthesis. Every change in the input
+// level is added to the output as a windowed-sinc step, so the output contains
+// no energy above the output Nyquist frequency and does not alias.
+type Resampler struct {
+	clockRate  float64
+	sampleRate float64
+	ratio      float64 // Output samples per input clock
+
+	time  float64 // Position of the current input clock within the output sample
+	level float32 // Last input level
+
+	// Ring buffer of pending step contributions, integrated into the output
+	steps      [resampleKernelWidth]float32
+	stepsHead  int
+	integrator float32
+
+	// Filters approximating the NES output stage
+	highPass1 AudioFilter
+	highPass2 AudioFilter
+	lowPass   AudioFilter
+}
+
+const (
+	resampleKernelWidth  = 16 // Taps per step, in output samples
+	resampleKernelPhases = 64 // Sub-sample resolution of step positions
+	resampleCutoff       = 0.45
+)
+
+// Band-limited impulses for each sub-sample phase. Integrating the output turns
+// them into band-limited steps.
+var resampleKernel = makeResampleKernel()
+
+func makeResampleKernel() [resampleKernelPhases][resampleKernelWidth]float32 {
+	var kernel [resampleKernelPhases][resampleKernelWidth]float32
+	for p := 0; p < resampleKernelPhases; p++ {
+		frac := float64(p) / resampleKernelPhases
+		sum := 0.0
+		var taps [resampleKernelWidth]float64
+		for k := range taps {
+			x := float64(k) - resampleKernelWidth/2 - frac
+			sinc := 2 * resampleCutoff
+			if x != 0 {
+				sinc = math.Sin(2*math.Pi*resampleCutoff*x) / (math.Pi * x)
+			}
+			// Blackman window over the kernel span
+			w := (x + resampleKernelWidth/2) / resampleKernelWidth
+			window := 0.42 - 0.5*math.Cos(2*math.Pi*w) + 0.08*math.Cos(4*math.Pi*w)
+			taps[k] = sinc * window
+			sum += taps[k]
+		}
+		// Normalize so each step reaches exactly its full height
+		for k, tap := range taps {
+			kernel[p][k] = float32(tap / sum)
+		}
+	}
+	return kernel
+}
+
+func NewResampler(clockRate, sampleRate float64) *Resampler {
+	r := &Resampler{
+		clockRate: clockRate,
+		highPass1: NewHighPassFilter(90, sampleRate),
+		highPass2: NewHighPassFilter(440, sampleRate),
+		lowPass:   NewLowPassFilter(14000, sampleRate),
+	}
+	r.SetSampleRate(sampleRate)
+	return r
+}
+
+// Changes the output rate. Small adjustments keep the output in step with an
+// audio device whose clock drifts from the emulated one; the filters keep their
+// original tuning.
+func (r *Resampler) SetSampleRate(sampleRate float64) {
+	r.sampleRate = sampleRate
+	r.ratio = sampleRate / r.clockRate
+}
+
+// Advances one input clock at the given level, in [0, 1]. Returns a sample
+// when the clock completes one.
+func (r *Resampler) Clock(level float32) (int16, bool) {
+	if delta := level - r.level; delta != 0 {
+		r.level = level
+		phase := &resampleKernel[int(r.time*resampleKernelPhases)]
+		for k, tap := range phase {
+			r.steps[(r.stepsHead+k)%resampleKernelWidth] += delta * tap
+		}
+	}
+
+	r.time += r.ratio
+	if r.time < 1 {
+		return 0, false
+	}
+	r.time -= 1
+
+	// The oldest slot has received every step that overlaps it
+	r.integrator += r.steps[r.stepsHead]
+	r.steps[r.stepsHead] = 0
+	r.stepsHead = (r.stepsHead + 1) % resampleKernelWidth
+
+	out := r.lowPass.Apply(r.highPass2.Apply(r.highPass1.Apply(r.integrator)))
+	return toSample(out), true
+}
+
+func toSample(val float32) int16 {
+	switch {
+	case val > 1:
+		return math.MaxInt16
+	case val < -1:
+		return -math.MaxInt16
+	}
+	return int16(val * math.MaxInt16)
+}
+
+// First-order IIR filter
+type AudioFilter struct {
+	b0, b1, a1 float32
+	prevIn     float32
+	prevOut    float32
+}
+
+func NewHighPassFilter(cutoff, sampleRate float64) AudioFilter {
+	rc := 1 / (2 * math.Pi * cutoff)
+	alpha := float32(rc / (rc + 1/sampleRate))
+	return AudioFilter{b0: alpha, b1: -alpha, a1: alpha}
+}
+
+func NewLowPassFilter(cutoff, sampleRate float64) AudioFilter {
+	rc := 1 / (2 * math.Pi * cutoff)
+	alpha := float32((1 / sampleRate) / (rc + 1/sampleRate))
+	return AudioFilter{b0: alpha, a1: 1 - alpha}
+}
+
+func (f *AudioFilter) Apply(in float32) float32 {
+	out := f.b0*in + f.b1*f.prevIn + f.a1*f.prevOut
+	f.prevIn = in
+	f.prevOut = out
+	return out
+}
@@ -0,0 +1,41 @@
+package main
+
+import "testing"
+
+func TestResamplerRate(t *testing.T) {
+	r := NewResampler(NtscCpuFrequency, 48000)
+	samples := 0
+	for i := 0; i < NtscCpuFrequency; i++ {
+		if _, ok := r.Clock(0); ok {
+			samples++
+		}
+	}
+	if samples < 47999 || samples > 48000 {
+		t.Errorf("Produced %v samples in one second, expected 48000", samples)
+	}
+}
+
+func TestResamplerRejectsUltrasonic(t *testing.T) {
+	// A 30 kHz square wave is above the output Nyquist frequency and must not alias
+	// into the audible band
+	r := NewResampler(NtscCpuFrequency, 44100)
+	halfPeriod := NtscCpuFrequency / 60000
+	peak := int16(0)
+	for i := 0; i < NtscCpuFrequency/10; i++ {
+		level := float32(0)
+		if (i/halfPeriod)&1 == 1 {
+			level = 0.5
+		}
+		if sample, ok := r.Clock(level); ok && i > NtscCpuFrequency/20 {
+			if sample < 0 {
+				sample = -sample
+			}
+			if sample > peak {
+				peak = sample
+			}
+		}
+	}
+	if peak > 0x7fff/50 {
+		t.Errorf("Ultrasonic input produced peak output %v", peak)
+	}
+}
@@ -12,10 +12,12 @@ type INesHeader struct {
 	ChrRom8kBanks  byte
 	Flags6         byte
 	Flags7         byte
-	PrgRam8kBanks  byte
+	PrgRam8kBanks  byte // NES 2.0: submapper in bits 4-7
 	Flags9         byte
 	Flags10        byte
-	Zero           [5]byte
+	Flags11        byte
+	Flags12        byte // NES 2.0: region in bits 0-1
+	Zero           [3]byte
 }
 
 type Rom struct {
@@ -62,3 +64,37 @@ func LoadRom(filename string) (*Rom, error) {
 func (rom Rom) Mapper() uint8 {
 	return rom.header.Flags7&0xf0 | rom.header.Flags6>>4
 }
+
+// Whether the board has its own RAM for all four nametables
+func (rom Rom) FourScreen() bool {
+	return rom.header.Flags6&0x08 == 0x08
+}
+
+func (rom Rom) Nes20() bool {
+	return rom.header.Flags7&0x0c == 0x08
+}
+
+// Returns the NES 2.0 submapper, which picks between board variants that
+// share a mapper number, or 0 for iNES headers
+func (rom Rom) Submapper() uint8 {
+	if rom.Nes20() {
+		return rom.header.PrgRam8kBanks >> 4
+	}
+	return 0
+}
+
+func (rom Rom) Region() Region {
+	if rom.Nes20() {
+		switch rom.header.Flags12 & 3 {
+		case 1:
+			return RegionPal
+		case 3:
+			return RegionDendy
+		}
+		return RegionNtsc // NTSC or multi-region
+	}
+	if rom.header.Flags9&1 == 1 {
+		return RegionPal
+	}
+	return RegionNtsc
+}
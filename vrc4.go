@@ -0,0 +1,186 @@
+package main
+
+// Konami VRC2 and VRC4 (mappers 21, 22, 23 and 25). The boards differ mostly in
+// which CPU address lines select the register within each 4 KB range, which
+// NES 2.0 submappers tell apart.
+type Vrc4 struct {
+	rom *Rom
+
+	// RAM
+	prgRam []uint8
+	chrRam []uint8
+
+	// Address lines wired to register bits 0 and 1
+	lines [2]uint16
+
+	// VRC2 lacks the IRQ, PRG swap mode and single-screen mirroring, and VRC2a
+	// ignores the low bit of CHR banks
+	vrc2     bool
+	chrShift uint
+
+	// Address lines that select VRC2 mirroring when the board is unknown
+	vrc2Lines uint16
+
+	// Registers
+	prgBanks  [2]uint8  // 0x8000-0x8003 and 0xa000-0xa003: 8 KB banks
+	mirroring uint8     // 0x9000-0x9001
+	prgSwap   bool      // 0x9002-0x9003 bit 1: swaps 0x8000 and 0xc000
+	chrBanks  [8]uint16 // 0xb000-0xe003: 1 KB banks, written a nibble at a time
+
+	irq VrcIrq
+}
+
+func NewVrc4(rom *Rom) *Vrc4 {
+	vrc4 := &Vrc4{
+		rom:    rom,
+		prgRam: make([]uint8, 8192),
+		chrRam: make([]uint8, 8192)}
+
+	// Without a submapper, lines of both variants sharing a mapper number are
+	// combined, since games only write addresses decoding the same register.
+	// VRC2b games on mapper 23 write their 1-bit mirroring register at any of
+	// 0x9000-0x9003, so those addresses keep VRC2 behaviour, and VRC4f, which
+	// uses the same lines, needs submapper 1. VRC2c shares its lines with VRC4b
+	// on mapper 25 and needs submapper 3.
+	switch sub := rom.Submapper(); rom.Mapper() {
+	case 21:
+		switch sub {
+		case 1: // VRC4a
+			vrc4.lines = [2]uint16{0x02, 0x04}
+		case 2: // VRC4c
+			vrc4.lines = [2]uint16{0x40, 0x80}
+		default:
+			vrc4.lines = [2]uint16{0x42, 0x84}
+		}
+	case 22: // VRC2a
+		vrc4.lines = [2]uint16{0x02, 0x01}
+		vrc4.vrc2 = true
+		vrc4.chrShift = 1
+	case 23:
+		switch sub {
+		case 1: // VRC4f
+			vrc4.lines = [2]uint16{0x01, 0x02}
+		case 2: // VRC4e
+			vrc4.lines = [2]uint16{0x04, 0x08}
+		case 3: // VRC2b
+			vrc4.lines = [2]uint16{0x01, 0x02}
+			vrc4.vrc2 = true
+		default:
+			vrc4.lines = [2]uint16{0x05, 0x0a}
+			vrc4.vrc2Lines = 0x03
+		}
+	case 25:
+		switch sub {
+		case 1: // VRC4b
+			vrc4.lines = [2]uint16{0x02, 0x01}
+		case 2: // VRC4d
+			vrc4.lines = [2]uint16{0x08, 0x04}
+		case 3: // VRC2c
+			vrc4.lines = [2]uint16{0x02, 0x01}
+			vrc4.vrc2 = true
+		default:
+			vrc4.lines = [2]uint16{0x0a, 0x05}
+		}
+	}
+	return vrc4
+}
+
+func (vrc4 *Vrc4) LoadPrg(addr uint16) uint8 {
+	secondLast := len(vrc4.rom.prg)/0x2000 - 2
+	switch {
+	case addr < 0x6000:
+		return 0
+	case addr < 0x8000:
+		return vrc4.prgRam[addr&0x1fff]
+	case addr < 0xa000:
+		if vrc4.prgSwap {
+			return loadBanked(vrc4.rom.prg, secondLast, 0x2000, addr)
+		}
+		return loadBanked(vrc4.rom.prg, int(vrc4.prgBanks[0]), 0x2000, addr)
+	case addr < 0xc000:
+		return loadBanked(vrc4.rom.prg, int(vrc4.prgBanks[1]), 0x2000, addr)
+	case addr < 0xe000:
+		if vrc4.prgSwap {
+			return loadBanked(vrc4.rom.prg, int(vrc4.prgBanks[0]), 0x2000, addr)
+		}
+		return loadBanked(vrc4.rom.prg, secondLast, 0x2000, addr)
+	}
+	return loadBanked(vrc4.rom.prg, secondLast+1, 0x2000, addr)
+}
+
+func (vrc4 *Vrc4) StorePrg(addr uint16, val uint8) {
+	if addr < 0x8000 {
+		if addr >= 0x6000 {
+			vrc4.prgRam[addr&0x1fff] = val
+		}
+		return
+	}
+
+	reg := addr & 0xf000
+	if addr&vrc4.lines[0] != 0 {
+		reg |= 1
+	}
+	if addr&vrc4.lines[1] != 0 {
+		reg |= 2
+	}
+
+	switch {
+	case reg < 0x9000:
+		vrc4.prgBanks[0] = val & 0x1f
+	case reg < 0xa000:
+		if vrc4.vrc2 || addr&vrc4.vrc2Lines != 0 {
+			vrc4.mirroring = val & 1
+		} else if reg&2 == 0 {
+			vrc4.mirroring = val & 3
+		} else {
+			vrc4.prgSwap = val&2 == 2
+		}
+	case reg < 0xb000:
+		vrc4.prgBanks[1] = val & 0x1f
+	case reg < 0xf000:
+		// Each 4 KB range holds two banks, low nibble first
+		bank := (reg-0xb000)>>12*2 + (reg&2)>>1
+		if reg&1 == 0 {
+			vrc4.chrBanks[bank] = vrc4.chrBanks[bank]&0x1f0 | uint16(val&0xf)
+		} else {
+			vrc4.chrBanks[bank] = vrc4.chrBanks[bank]&0xf | uint16(val&0x1f)<<4
+		}
+	case vrc4.vrc2:
+	case reg == 0xf000:
+		vrc4.irq.latch = vrc4.irq.latch&0xf0 | val&0xf
+	case reg == 0xf001:
+		vrc4.irq.latch = vrc4.irq.latch&0xf | val<<4
+	case reg == 0xf002:
+		vrc4.irq.writeControl(val)
+	case reg == 0xf003:
+		vrc4.irq.acknowledge()
+	}
+}
+
+func (vrc4 *Vrc4) LoadChr(addr uint16) uint8 {
+	if vrc4.rom.header.ChrRom8kBanks == 0 {
+		return vrc4.chrRam[addr]
+	}
+	return loadBanked(vrc4.rom.chr, int(vrc4.chrBanks[addr>>10]>>vrc4.chrShift), 0x400, addr)
+}
+
+func (vrc4 *Vrc4) StoreChr(addr uint16, val uint8) {
+	if vrc4.rom.header.ChrRom8kBanks == 0 {
+		vrc4.chrRam[addr] = val
+	}
+}
+
+func (vrc4 *Vrc4) Mirroring() Mirroring {
+	switch vrc4.mirroring {
+	case 0:
+		return MirrorVertical
+	case 1:
+		return MirrorHorizontal
+	case 2:
+		return MirrorSingleUpper
+	}
+	return MirrorSingleLower
+}
+
+func (vrc4 *Vrc4) ClockCpu() { vrc4.irq.clock() }
+func (vrc4 *Vrc4) Irq() bool { return vrc4.irq.irq }
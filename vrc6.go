@@ -0,0 +1,295 @@
+package main
+
+// Konami VRC6 (mappers 24 and 26), with two pulse channels and a sawtooth
+type Vrc6 struct {
+	rom *Rom
+
+	// RAM
+	prgRam []uint8
+	chrRam []uint8
+
+	// Mapper 26 swaps address lines A0 and A1
+	swapLines bool
+
+	// Registers
+	prgBank16  uint8    // 0x8000-0x8003: 16 KB at 0x8000
+	prgBank8   uint8    // 0xc000-0xc003: 8 KB at 0xc000
+	chrBanks   [8]uint8 // 0xd000-0xe003: 1 KB banks
+	ppuControl uint8    // 0xb003: banking mode, mirroring, PRG RAM enable
+
+	irq VrcIrq
+
+	// Audio
+	pulse1    Vrc6Pulse
+	pulse2    Vrc6Pulse
+	saw       Vrc6Saw
+	audioHalt bool
+	freqShift uint // Divides all periods by 16 or 256 when set
+}
+
+// A VRC6 pulse at full volume roughly matches a 2A03 pulse at full volume
+const vrc6OutputScale = 0.15 / 15
+
+func NewVrc6(rom *Rom, swapLines bool) *Vrc6 {
+	return &Vrc6{
+		rom:       rom,
+		swapLines: swapLines,
+		prgRam:    make([]uint8, 8192),
+		chrRam:    make([]uint8, 8192)}
+}
+
+func (vrc6 *Vrc6) LoadPrg(addr uint16) uint8 {
+	switch {
+	case addr < 0x6000:
+		return 0
+	case addr < 0x8000:
+		if vrc6.ppuControl&0x80 == 0 {
+			return 0 // RAM disabled
+		}
+		return vrc6.prgRam[addr-0x6000]
+	case addr < 0xc000:
+		return loadBanked(vrc6.rom.prg, int(vrc6.prgBank16), 0x4000, addr)
+	case addr < 0xe000:
+		return loadBanked(vrc6.rom.prg, int(vrc6.prgBank8), 0x2000, addr)
+	}
+	return loadBanked(vrc6.rom.prg, len(vrc6.rom.prg)/0x2000-1, 0x2000, addr)
+}
+
+func (vrc6 *Vrc6) StorePrg(addr uint16, val uint8) {
+	if addr < 0x8000 {
+		if addr >= 0x6000 && vrc6.ppuControl&0x80 == 0x80 {
+			vrc6.prgRam[addr-0x6000] = val
+		}
+		return
+	}
+
+	reg := addr & 0xf003
+	if vrc6.swapLines {
+		reg = (reg & 0xf000) | (reg&1)<<1 | (reg&2)>>1
+	}
+
+	switch reg {
+	case 0x8000, 0x8001, 0x8002, 0x8003:
+		vrc6.prgBank16 = val & 0xf
+	case 0x9000:
+		vrc6.pulse1.writeControl(val)
+	case 0x9001:
+		vrc6.pulse1.writePeriodLow(val)
+	case 0x9002:
+		vrc6.pulse1.writePeriodHigh(val)
+	case 0x9003:
+		vrc6.audioHalt = val&1 == 1
+		switch {
+		case val&4 == 4:
+			vrc6.freqShift = 8
+		case val&2 == 2:
+			vrc6.freqShift = 4
+		default:
+			vrc6.freqShift = 0
+		}
+	case 0xa000:
+		vrc6.pulse2.writeControl(val)
+	case 0xa001:
+		vrc6.pulse2.writePeriodLow(val)
+	case 0xa002:
+		vrc6.pulse2.writePeriodHigh(val)
+	case 0xb000:
+		vrc6.saw.rate = val & 0x3f
+	case 0xb001:
+		vrc6.saw.period = (vrc6.saw.period & 0xf00) | uint16(val)
+	case 0xb002:
+		vrc6.saw.period = (vrc6.saw.period & 0xff) | uint16(val&0xf)<<8
+		vrc6.saw.enabled = val&0x80 == 0x80
+		if !vrc6.saw.enabled {
+			vrc6.saw.accumulator = 0
+			vrc6.saw.step = 0
+		}
+	case 0xb003:
+		vrc6.ppuControl = val
+	case 0xc000, 0xc001, 0xc002, 0xc003:
+		vrc6.prgBank8 = val & 0x1f
+	case 0xd000, 0xd001, 0xd002, 0xd003:
+		vrc6.chrBanks[reg&3] = val
+	case 0xe000, 0xe001, 0xe002, 0xe003:
+		vrc6.chrBanks[4+reg&3] = val
+	case 0xf000:
+		vrc6.irq.latch = val
+	case 0xf001:
+		vrc6.irq.writeControl(val)
+	case 0xf002:
+		vrc6.irq.acknowledge()
+	}
+}
+
+// Better emulation would support the other PPU banking modes of 0xb003, which
+// no licensed game uses
+func (vrc6 *Vrc6) LoadChr(addr uint16) uint8 {
+	if vrc6.rom.header.ChrRom8kBanks == 0 {
+		return vrc6.chrRam[addr]
+	}
+	return loadBanked(vrc6.rom.chr, int(vrc6.chrBanks[addr>>10]), 0x400, addr)
+}
+
+func (vrc6 *Vrc6) StoreChr(addr uint16, val uint8) {
+	if vrc6.rom.header.ChrRom8kBanks == 0 {
+		vrc6.chrRam[addr] = val
+	}
+}
+
+func (vrc6 *Vrc6) Mirroring() Mirroring {
+	switch (vrc6.ppuControl >> 2) & 3 {
+	case 0:
+		return MirrorVertical
+	case 1:
+		return MirrorHorizontal
+	case 2:
+		return MirrorSingleUpper
+	}
+	return MirrorSingleLower
+}
+
+func (vrc6 *Vrc6) ClockCpu() { vrc6.irq.clock() }
+func (vrc6 *Vrc6) Irq() bool { return vrc6.irq.irq }
+
+func (vrc6 *Vrc6) ClockAudio() {
+	if vrc6.audioHalt {
+		return
+	}
+	vrc6.pulse1.clock(vrc6.freqShift)
+	vrc6.pulse2.clock(vrc6.freqShift)
+	vrc6.saw.clock(vrc6.freqShift)
+}
+
+func (vrc6 *Vrc6) AudioOutput() float32 {
+	level := vrc6.pulse1.output() + vrc6.pulse2.output() + vrc6.saw.output()
+	return vrc6OutputScale * float32(level)
+}
+
+type Vrc6Pulse struct {
+	volume   uint8
+	duty     uint8
+	constant bool // Ignore the duty and always output the volume
+	enabled  bool
+	period   uint16
+	timer    uint16
+	step     uint8 // Counts down through 16 duty steps
+}
+
+func (pulse *Vrc6Pulse) writeControl(val uint8) {
+	pulse.constant = val&0x80 == 0x80
+	pulse.duty = (val >> 4) & 7
+	pulse.volume = val & 0xf
+}
+
+func (pulse *Vrc6Pulse) writePeriodLow(val uint8) {
+	pulse.period = (pulse.period & 0xf00) | uint16(val)
+}
+
+func (pulse *Vrc6Pulse) writePeriodHigh(val uint8) {
+	pulse.period = (pulse.period & 0xff) | uint16(val&0xf)<<8
+	pulse.enabled = val&0x80 == 0x80
+	if !pulse.enabled {
+		pulse.step = 15
+	}
+}
+
+func (pulse *Vrc6Pulse) clock(shift uint) {
+	if !pulse.enabled {
+		return
+	}
+	if pulse.timer > 0 {
+		pulse.timer--
+		return
+	}
+	pulse.timer = pulse.period >> shift
+	pulse.step = (pulse.step - 1) & 0xf
+}
+
+func (pulse *Vrc6Pulse) output() uint8 {
+	if pulse.enabled && (pulse.constant || pulse.step <= pulse.duty) {
+		return pulse.volume
+	}
+	return 0
+}
+
+type Vrc6Saw struct {
+	rate        uint8 // Added to the accumulator every other step
+	enabled     bool
+	period      uint16
+	timer       uint16
+	step        uint8 // 14 steps per sawtooth period
+	accumulator uint8
+}
+
+func (saw *Vrc6Saw) clock(shift uint) {
+	if !saw.enabled {
+		return
+	}
+	if saw.timer > 0 {
+		saw.timer--
+		return
+	}
+	saw.timer = saw.period >> shift
+
+	saw.step++
+	switch {
+	case saw.step == 14:
+		saw.step = 0
+		saw.accumulator = 0
+	case saw.step&1 == 0:
+		saw.accumulator += saw.rate
+	}
+}
+
+func (saw *Vrc6Saw) output() uint8 {
+	return saw.accumulator >> 3
+}
+
+// IRQ counter shared by the VRC family. It counts up from a latch, either every
+// CPU cycle or every scanline by way of a prescaler, and interrupts on overflow.
+type VrcIrq struct {
+	latch          uint8
+	counter        uint8
+	prescaler      int
+	enabled        bool
+	enableAfterAck bool
+	cycleMode      bool
+	irq            bool
+}
+
+const vrcIrqPrescalerPeriod = 341 // In thirds of a CPU cycle, one scanline
+
+func (irq *VrcIrq) writeControl(val uint8) {
+	irq.enableAfterAck = val&1 == 1
+	irq.enabled = val&2 == 2
+	irq.cycleMode = val&4 == 4
+	irq.irq = false
+	if irq.enabled {
+		irq.counter = irq.latch
+		irq.prescaler = vrcIrqPrescalerPeriod
+	}
+}
+
+func (irq *VrcIrq) acknowledge() {
+	irq.irq = false
+	irq.enabled = irq.enableAfterAck
+}
+
+func (irq *VrcIrq) clock() {
+	if !irq.enabled {
+		return
+	}
+	if !irq.cycleMode {
+		irq.prescaler -= 3
+		if irq.prescaler > 0 {
+			return
+		}
+		irq.prescaler += vrcIrqPrescalerPeriod
+	}
+	if irq.counter == 0xff {
+		irq.counter = irq.latch
+		irq.irq = true
+	} else {
+		irq.counter++
+	}
+}
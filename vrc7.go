@@ -0,0 +1,452 @@
+package main
+
+import "math"
+
+// Konami VRC7 (mapper 85), with six channels of FM sound
+type Vrc7 struct {
+	rom *Rom
+
+	// RAM
+	prgRam []uint8
+	chrRam []uint8
+
+	// Address line wired to register bit 4: A4 on VRC7a, A3 on VRC7b
+	line uint16
+
+	// Registers
+	prgBanks [3]uint8 // 0x8000, 0x8010 and 0x9000: 8 KB banks
+	chrBanks [8]uint8 // 0xa000-0xd010: 1 KB banks
+	control  uint8    // 0xe000: mirroring, audio reset, PRG RAM enable
+
+	irq VrcIrq
+
+	audio Vrc7Audio
+}
+
+func NewVrc7(rom *Rom) *Vrc7 {
+	vrc7 := &Vrc7{
+		rom:    rom,
+		prgRam: make([]uint8, 8192),
+		chrRam: make([]uint8, 8192)}
+	switch rom.Submapper() {
+	case 1:
+		vrc7.line = 0x08
+	case 2:
+		vrc7.line = 0x10
+	default:
+		vrc7.line = 0x18
+	}
+	vrc7.audio.reset()
+	return vrc7
+}
+
+func (vrc7 *Vrc7) LoadPrg(addr uint16) uint8 {
+	switch {
+	case addr < 0x6000:
+		return 0
+	case addr < 0x8000:
+		if vrc7.control&0x80 == 0 {
+			return 0 // RAM disabled
+		}
+		return vrc7.prgRam[addr-0x6000]
+	case addr < 0xe000:
+		return loadBanked(vrc7.rom.prg, int(vrc7.prgBanks[(addr-0x8000)>>13]), 0x2000, addr)
+	}
+	return loadBanked(vrc7.rom.prg, len(vrc7.rom.prg)/0x2000-1, 0x2000, addr)
+}
+
+func (vrc7 *Vrc7) StorePrg(addr uint16, val uint8) {
+	if addr < 0x8000 {
+		if addr >= 0x6000 && vrc7.control&0x80 == 0x80 {
+			vrc7.prgRam[addr-0x6000] = val
+		}
+		return
+	}
+
+	// The audio ports decode A4 and A5 on both boards, so VRC7b, which moves
+	// register bit 4 to A3, still reaches them at 0x9010 and 0x9030
+	if addr&0xf010 == 0x9010 {
+		if addr&0x20 == 0 {
+			vrc7.audio.register = val
+		} else {
+			vrc7.audio.write(val)
+		}
+		return
+	}
+
+	reg := addr & 0xf000
+	if addr&vrc7.line != 0 {
+		reg |= 0x10
+	}
+
+	switch reg {
+	case 0x8000:
+		vrc7.prgBanks[0] = val & 0x3f
+	case 0x8010:
+		vrc7.prgBanks[1] = val & 0x3f
+	case 0x9000:
+		vrc7.prgBanks[2] = val & 0x3f
+	case 0xa000, 0xa010, 0xb000, 0xb010, 0xc000, 0xc010, 0xd000, 0xd010:
+		vrc7.chrBanks[(reg-0xa000)>>11|(reg&0x10)>>4] = val
+	case 0xe000:
+		vrc7.control = val
+		if val&0x40 == 0x40 {
+			vrc7.audio.reset()
+		}
+	case 0xe010:
+		vrc7.irq.latch = val
+	case 0xf000:
+		vrc7.irq.writeControl(val)
+	case 0xf010:
+		vrc7.irq.acknowledge()
+	}
+}
+
+func (vrc7 *Vrc7) LoadChr(addr uint16) uint8 {
+	if vrc7.rom.header.ChrRom8kBanks == 0 {
+		return loadBanked(vrc7.chrRam, int(vrc7.chrBanks[addr>>10]), 0x400, addr)
+	}
+	return loadBanked(vrc7.rom.chr, int(vrc7.chrBanks[addr>>10]), 0x400, addr)
+}
+
+func (vrc7 *Vrc7) StoreChr(addr uint16, val uint8) {
+	if vrc7.rom.header.ChrRom8kBanks == 0 {
+		vrc7.chrRam[(int(vrc7.chrBanks[addr>>10])*0x400)%len(vrc7.chrRam)+int(addr&0x3ff)] = val
+	}
+}
+
+func (vrc7 *Vrc7) Mirroring() Mirroring {
+	switch vrc7.control & 3 {
+	case 0:
+		return MirrorVertical
+	case 1:
+		return MirrorHorizontal
+	case 2:
+		return MirrorSingleUpper
+	}
+	return MirrorSingleLower
+}
+
+func (vrc7 *Vrc7) ClockCpu() { vrc7.irq.clock() }
+func (vrc7 *Vrc7) Irq() bool { return vrc7.irq.irq }
+
+func (vrc7 *Vrc7) ClockAudio() {
+	if vrc7.control&0x40 == 0 {
+		vrc7.audio.clock()
+	}
+}
+
+func (vrc7 *Vrc7) AudioOutput() float32 {
+	if vrc7.control&0x40 == 0x40 {
+		return 0
+	}
+	return vrc7.audio.out
+}
+
+// VRC7 audio: a cut-down Yamaha OPLL with six channels, each a modulator
+// operator modulating the phase of a carrier. Channels play one of 15 fixed
+// instruments or a custom one. The synthesis approximates the chip's
+// logarithmic envelopes and waveforms in floating point.
+type Vrc7Audio struct {
+	register  uint8    // Selected by 0x9010, written at 0x9030
+	custom    [8]uint8 // Registers 0-7: the custom instrument
+	channels  [6]Vrc7Channel
+	prescaler int // The chip makes one sample every 36 CPU cycles
+
+	amPhase float64 // Tremolo LFO, in cycles
+	fmPhase float64 // Vibrato LFO, in cycles
+
+	out float32
+}
+
+type Vrc7Channel struct {
+	fnum       uint16 // Registers 0x10-0x15, bit 0 of 0x20-0x25
+	block      uint8  // Octave
+	sustain    bool   // Slow release
+	keyOn      bool
+	instrument uint8 // Registers 0x30-0x35 high nibble
+	volume     uint8 // Low nibble, 3 dB steps
+
+	patch    [2]Vrc7OperatorPatch // Modulator, carrier
+	feedback uint8
+	ops      [2]Vrc7Operator
+	modOut   [2]float64 // Last two modulator outputs, for feedback
+}
+
+type Vrc7OperatorPatch struct {
+	tremolo      bool
+	vibrato      bool
+	sustained    bool // Hold the sustain level until key off
+	keyScale     bool // Scale envelope rates more with pitch
+	mult         float64
+	ksl          uint8   // Attenuation with pitch
+	level        float64 // Modulator total level in dB
+	rectified    bool    // Drop the negative half of the sine
+	attack       uint8
+	decay        uint8
+	sustainLevel uint8 // 3 dB steps
+	release      uint8
+}
+
+type Vrc7Operator struct {
+	phase float64 // In cycles
+	env   float64 // Attenuation in dB
+	stage int
+}
+
+// Envelope stages
+const (
+	vrc7Attack = iota
+	vrc7Decay
+	vrc7Sustain
+	vrc7Release
+)
+
+const (
+	vrc7SampleCycles = 36
+	vrc7SampleRate   = 3579545.0 / 72
+	vrc7MaxEnv       = 48.0 // dB, silent
+
+	// A channel at full volume swings about as far as a 2A03 pulse at full
+	// volume
+	vrc7OutputScale = 0.075
+)
+
+// Built-in instruments 1-15, in the layout of the custom instrument registers
+var vrc7Patches = [16][8]uint8{
+	{},
+	{0x03, 0x21, 0x05, 0x06, 0xe8, 0x81, 0x42, 0x27}, // Buzzy bell
+	{0x13, 0x41, 0x14, 0x0d, 0xd8, 0xf6, 0x23, 0x12}, // Guitar
+	{0x11, 0x11, 0x08, 0x08, 0xfa, 0xb2, 0x20, 0x12}, // Wurly
+	{0x31, 0x61, 0x0c, 0x07, 0xa8, 0x64, 0x61, 0x27}, // Flute
+	{0x32, 0x21, 0x1e, 0x06, 0xe1, 0x76, 0x01, 0x28}, // Clarinet
+	{0x02, 0x01, 0x06, 0x00, 0xa3, 0xe2, 0xf4, 0xf4}, // Synth
+	{0x21, 0x61, 0x1d, 0x07, 0x82, 0x81, 0x11, 0x07}, // Trumpet
+	{0x23, 0x21, 0x22, 0x17, 0xa2, 0x72, 0x01, 0x17}, // Organ
+	{0x35, 0x11, 0x25, 0x00, 0x40, 0x73, 0x72, 0x01}, // Bells
+	{0xb5, 0x01, 0x0f, 0x0f, 0xa8, 0xa5, 0x51, 0x02}, // Vibes
+	{0x17, 0xc1, 0x24, 0x07, 0xf8, 0xf8, 0x22, 0x12}, // Vibraphone
+	{0x71, 0x23, 0x11, 0x06, 0x65, 0x74, 0x18, 0x16}, // Tutti
+	{0x01, 0x02, 0xd3, 0x05, 0xc9, 0x95, 0x03, 0x02}, // Fretless
+	{0x61, 0x63, 0x0c, 0x00, 0x94, 0xc0, 0x33, 0xf6}, // Synth bass
+	{0x21, 0x72, 0x0d, 0x00, 0xc1, 0xd5, 0x56, 0x06}, // Sweep
+}
+
+var vrc7Multipliers = [16]float64{0.5, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 10, 12, 12, 15, 15}
+
+// Key scale attenuation in dB at octave 7 by the top 4 bits of F-number, which
+// drops 6 dB per octave below
+var vrc7KeyScaleLevels = [16]float64{
+	0, 18, 24, 27.75, 30, 32.25, 33.75, 35.25, 36, 37.5, 38.25, 39, 39.75, 40.5, 41.25, 42}
+
+// Envelope steps per sample by effective rate (0-63). Rate 4 decays through the
+// 48 dB range in about 20 s and attacks in about 2.8 s, each 4 steps up halving
+// the time.
+var vrc7DecaySteps, vrc7AttackSteps = makeVrc7EnvelopeSteps()
+
+func makeVrc7EnvelopeSteps() (decay [64]float64, attack [64]float64) {
+	for rate := 4; rate < 64; rate++ {
+		scale := math.Exp2(float64(rate-4) / 4)
+		decay[rate] = vrc7MaxEnv / (19.64 * vrc7SampleRate) * scale
+		// The attack approaches 0 dB exponentially, about ln 49 time constants
+		// from silence
+		attack[rate] = math.Min(1, 3.89/(2.826*vrc7SampleRate)*scale)
+	}
+	for rate := 60; rate < 64; rate++ {
+		attack[rate] = 1 // Instant
+	}
+	return
+}
+
+func decodeVrc7Patch(patch *[8]uint8) (mod, car Vrc7OperatorPatch, feedback uint8) {
+	for i, op := range []*Vrc7OperatorPatch{&mod, &car} {
+		op.tremolo = patch[i]&0x80 == 0x80
+		op.vibrato = patch[i]&0x40 == 0x40
+		op.sustained = patch[i]&0x20 == 0x20
+		op.keyScale = patch[i]&0x10 == 0x10
+		op.mult = vrc7Multipliers[patch[i]&0xf]
+		op.ksl = patch[2+i] >> 6
+		op.rectified = patch[3]&(0x08<<uint(i)) != 0
+		op.attack = patch[4+i] >> 4
+		op.decay = patch[4+i] & 0xf
+		op.sustainLevel = patch[6+i] >> 4
+		op.release = patch[6+i] & 0xf
+	}
+	mod.level = float64(patch[2]&0x3f) * 0.75
+	return mod, car, patch[3] & 7
+}
+
+func (audio *Vrc7Audio) reset() {
+	*audio = Vrc7Audio{register: audio.register}
+	for ch := range audio.channels {
+		audio.channels[ch].ops[0].env = vrc7MaxEnv
+		audio.channels[ch].ops[1].env = vrc7MaxEnv
+		audio.channels[ch].ops[0].stage = vrc7Release
+		audio.channels[ch].ops[1].stage = vrc7Release
+		audio.updatePatch(ch)
+	}
+}
+
+func (audio *Vrc7Audio) write(val uint8) {
+	switch reg := audio.register; {
+	case reg < 8:
+		audio.custom[reg] = val
+		for ch := range audio.channels {
+			if audio.channels[ch].instrument == 0 {
+				audio.updatePatch(ch)
+			}
+		}
+	case reg >= 0x10 && reg < 0x16:
+		ch := &audio.channels[reg&0xf]
+		ch.fnum = ch.fnum&0x100 | uint16(val)
+	case reg >= 0x20 && reg < 0x26:
+		ch := &audio.channels[reg&0xf]
+		ch.fnum = ch.fnum&0xff | uint16(val&1)<<8
+		ch.block = val >> 1 & 7
+		ch.sustain = val&0x20 == 0x20
+		keyOn := val&0x10 == 0x10
+		if keyOn && !ch.keyOn {
+			for op := range ch.ops {
+				ch.ops[op].phase = 0
+				ch.ops[op].stage = vrc7Attack
+			}
+		} else if !keyOn && ch.keyOn {
+			ch.ops[0].stage = vrc7Release
+			ch.ops[1].stage = vrc7Release
+		}
+		ch.keyOn = keyOn
+	case reg >= 0x30 && reg < 0x36:
+		ch := &audio.channels[reg&0xf]
+		ch.instrument = val >> 4
+		ch.volume = val & 0xf
+		audio.updatePatch(int(reg & 0xf))
+	}
+}
+
+func (audio *Vrc7Audio) updatePatch(ch int) {
+	channel := &audio.channels[ch]
+	patch := &vrc7Patches[channel.instrument]
+	if channel.instrument == 0 {
+		patch = &audio.custom
+	}
+	channel.patch[0], channel.patch[1], channel.feedback = decodeVrc7Patch(patch)
+}
+
+func (audio *Vrc7Audio) clock() {
+	audio.prescaler++
+	if audio.prescaler < vrc7SampleCycles {
+		return
+	}
+	audio.prescaler = 0
+
+	// Tremolo dips up to 4.8 dB at 3.7 Hz; vibrato bends up to 14 cents at 6.4 Hz
+	audio.amPhase = math.Mod(audio.amPhase+3.7/vrc7SampleRate, 1)
+	audio.fmPhase = math.Mod(audio.fmPhase+6.4/vrc7SampleRate, 1)
+	am := 4.8 * (1 - math.Abs(2*audio.amPhase-1))
+	vib := math.Exp2(14.0 / 1200 * math.Sin(2*math.Pi*audio.fmPhase))
+
+	var out float64
+	for ch := range audio.channels {
+		out += audio.channels[ch].sample(am, vib)
+	}
+	audio.out = float32(vrc7OutputScale * out)
+}
+
+// Returns the channel output in [-1, 1]
+func (ch *Vrc7Channel) sample(am float64, vib float64) float64 {
+	mod, car := &ch.ops[0], &ch.ops[1]
+	if car.stage == vrc7Release && car.env >= vrc7MaxEnv {
+		return 0
+	}
+
+	// Feedback shifts the modulator's phase by up to 4 pi
+	var feedback float64
+	if ch.feedback > 0 {
+		feedback = (ch.modOut[0] + ch.modOut[1]) / 2 * math.Exp2(float64(ch.feedback)-6)
+	}
+	m := mod.sample(ch, &ch.patch[0], feedback, ch.patch[0].level, am, vib)
+	ch.modOut[1] = ch.modOut[0]
+	ch.modOut[0] = m
+
+	// A full scale modulator shifts the carrier's phase by up to 4 pi
+	return car.sample(ch, &ch.patch[1], 2*m, float64(ch.volume)*3, am, vib)
+}
+
+// Advances the operator one sample and returns its output, with its phase
+// shifted by mod cycles and attenuated by level dB
+func (op *Vrc7Operator) sample(ch *Vrc7Channel, patch *Vrc7OperatorPatch, mod float64, level float64, am float64, vib float64) float64 {
+	op.clockEnvelope(ch, patch)
+
+	inc := float64(ch.fnum) * math.Exp2(float64(ch.block)-19) * patch.mult
+	if patch.vibrato {
+		inc *= vib
+	}
+	op.phase += inc
+	op.phase -= math.Floor(op.phase)
+
+	att := op.env + level
+	if patch.ksl > 0 {
+		ksl := vrc7KeyScaleLevels[ch.fnum>>5] - 6*float64(7-ch.block)
+		if ksl > 0 {
+			att += ksl * float64(uint(1)<<patch.ksl) / 4
+		}
+	}
+	if patch.tremolo {
+		att += am
+	}
+
+	wave := math.Sin(2 * math.Pi * (op.phase + mod))
+	if patch.rectified && wave < 0 {
+		wave = 0
+	}
+	return wave * math.Pow(10, -att/20)
+}
+
+func (op *Vrc7Operator) clockEnvelope(ch *Vrc7Channel, patch *Vrc7OperatorPatch) {
+	switch op.stage {
+	case vrc7Attack:
+		op.env -= (op.env + 1) * vrc7AttackSteps[ch.rate(patch.attack, patch.keyScale)]
+		if op.env <= 0 {
+			op.env = 0
+			op.stage = vrc7Decay
+		}
+	case vrc7Decay:
+		op.env += vrc7DecaySteps[ch.rate(patch.decay, patch.keyScale)]
+		if sustain := float64(patch.sustainLevel) * 3; op.env >= sustain {
+			op.env = sustain
+			op.stage = vrc7Sustain
+		}
+	case vrc7Sustain:
+		// Percussive instruments keep fading at the release rate
+		if !patch.sustained {
+			op.env += vrc7DecaySteps[ch.rate(patch.release, patch.keyScale)]
+		}
+	case vrc7Release:
+		release := uint8(7)
+		switch {
+		case ch.sustain:
+			release = 5
+		case patch.sustained:
+			release = patch.release
+		}
+		op.env += vrc7DecaySteps[ch.rate(release, patch.keyScale)]
+	}
+	if op.env > vrc7MaxEnv {
+		op.env = vrc7MaxEnv
+	}
+}
+
+// Returns the effective envelope rate, which rises with pitch
+func (ch *Vrc7Channel) rate(rate uint8, keyScale bool) int {
+	if rate == 0 {
+		return 0
+	}
+	keyRate := int(ch.block)<<1 | int(ch.fnum>>8)
+	if !keyScale {
+		keyRate >>= 2
+	}
+	if r := int(rate)*4 + keyRate; r < 64 {
+		return r
+	}
+	return 63
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"os"
+)
+
+// Canonical 44-byte header for 16-bit PCM
+type WavHeader struct {
+	RiffMagic     [4]byte
+	RiffSize      uint32
+	WaveMagic     [4]byte
+	FmtMagic      [4]byte
+	FmtSize       uint32
+	Format        uint16
+	Channels      uint16
+	SampleRate    uint32
+	ByteRate      uint32
+	BlockAlign    uint16
+	BitsPerSample uint16
+	DataMagic     [4]byte
+	DataSize      uint32
+}
+
+const wavHeaderSize = 44
+
+// Records mono 16-bit samples to a .wav file
+type WavWriter struct {
+	file       *os.File
+	out        *bufio.Writer
+	sampleRate int
+	samples    uint32
+	err        error // First write error, reported by Close
+}
+
+func CreateWav(filename string, sampleRate int) (*WavWriter, error) {
+	file, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	wav := &WavWriter{file: file, out: bufio.NewWriter(file), sampleRate: sampleRate}
+	// Write a placeholder header, completed with the sizes on close
+	if err = binary.Write(wav.out, binary.LittleEndian, wav.header()); err != nil {
+		file.Close()
+		return nil, err
+	}
+	return wav, nil
+}
+
+func (wav *WavWriter) header() *WavHeader {
+	dataSize := wav.samples * 2
+	return &WavHeader{
+		RiffMagic:     [4]byte{'R', 'I', 'F', 'F'},
+		RiffSize:      wavHeaderSize - 8 + dataSize,
+		WaveMagic:     [4]byte{'W', 'A', 'V', 'E'},
+		FmtMagic:      [4]byte{'f', 'm', 't', ' '},
+		FmtSize:       16,
+		Format:        1, // PCM
+		Channels:      1,
+		SampleRate:    uint32(wav.sampleRate),
+		ByteRate:      uint32(wav.sampleRate) * 2,
+		BlockAlign:    2,
+		BitsPerSample: 16,
+		DataMagic:     [4]byte{'d', 'a', 't', 'a'},
+		DataSize:      dataSize,
+	}
+}
+
+func (wav *WavWriter) Write(samples []int16) {
+	if wav.err != nil {
+		return
+	}
+	wav.err = binary.Write(wav.out, binary.LittleEndian, samples)
+	wav.samples += uint32(len(samples))
+}
+
+func (wav *WavWriter) Close() error {
+	err := wav.finish()
+	if closeErr := wav.file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+func (wav *WavWriter) finish() error {
+	if wav.err != nil {
+		return wav.err
+	}
+	if err := wav.out.Flush(); err != nil {
+		return err
+	}
+	if _, err := wav.file.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	return binary.Write(wav.file, binary.LittleEndian, wav.header())
+}
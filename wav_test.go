@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/binary"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWavWriter(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "out.wav")
+	wav, err := CreateWav(filename, 48000)
+	if err != nil {
+		t.Fatalf("Failed to create WAV: %v", err)
+	}
+	wav.Write([]int16{0, 1000, -1000})
+	wav.Write([]int16{32767})
+	if err := wav.Close(); err != nil {
+		t.Fatalf("Failed to close WAV: %v", err)
+	}
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("Failed to read WAV: %v", err)
+	}
+	if len(data) != wavHeaderSize+8 {
+		t.Fatalf("WAV is %v bytes, expected %v", len(data), wavHeaderSize+8)
+	}
+	if string(data[0:4]) != "RIFF" || string(data[8:12]) != "WAVE" || string(data[36:40]) != "data" {
+		t.Errorf("WAV header corrupted: %q", data[:wavHeaderSize])
+	}
+	if rate := binary.LittleEndian.Uint32(data[24:]); rate != 48000 {
+		t.Errorf("Sample rate %v, expected 48000", rate)
+	}
+	if size := binary.LittleEndian.Uint32(data[40:]); size != 8 {
+		t.Errorf("Data size %v, expected 8", size)
+	}
+	if sample := int16(binary.LittleEndian.Uint16(data[wavHeaderSize+4:])); sample != -1000 {
+		t.Errorf("Third sample %v, expected -1000", sample)
+	}
+}
+
+func TestApuRecording(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "out.wav")
+	wav, err := CreateWav(filename, 44100)
+	if err != nil {
+		t.Fatalf("Failed to create WAV: %v", err)
+	}
+	apu := NewApu()
+	apu.Recorder = wav
+
+	// Less than one buffer, with the output rate nudged as AudioPacer does
+	apu.resampler.SetSampleRate(44100 * (1 + AudioPacerMaxRateDelta))
+	apu.Step(NtscCpuFrequency / 100)
+	apu.FlushRecording()
+	if err := wav.Close(); err != nil {
+		t.Fatalf("Failed to close WAV: %v", err)
+	}
+
+	data, err := os.ReadFile(filename)
+	if err != nil {
+		t.Fatalf("Failed to read WAV: %v", err)
+	}
+	if samples := binary.LittleEndian.Uint32(data[40:]) / 2; samples < 440 || samples > 441 {
+		t.Errorf("Recorded %v samples in 10 ms, expected 441", samples)
+	}
+}